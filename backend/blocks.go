@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// The Slack library we use predates Block Kit, so messages with blocks,
+// modals and their interactions are built with these minimal types.
+// See https://api.slack.com/reference/block-kit
+
+type textObject struct {
+	Type  string `json:"type"` // "plain_text" or "mrkdwn"
+	Text  string `json:"text"`
+	Emoji bool   `json:"emoji,omitempty"`
+}
+
+func plainText(s string) *textObject {
+	return &textObject{Type: "plain_text", Text: s, Emoji: true}
+}
+
+func mrkdwnText(s string) *textObject {
+	return &textObject{Type: "mrkdwn", Text: s}
+}
+
+type optionObject struct {
+	Text        *textObject `json:"text"`
+	Value       string      `json:"value"`
+	Description *textObject `json:"description,omitempty"`
+}
+
+type optionGroup struct {
+	Label   *textObject     `json:"label"`
+	Options []*optionObject `json:"options"`
+}
+
+// blockElement is an interactive element: a button, a select menu or a
+// text input.
+type blockElement struct {
+	Type          string          `json:"type"`
+	ActionID      string          `json:"action_id"`
+	Text          *textObject     `json:"text,omitempty"`
+	Value         string          `json:"value,omitempty"`
+	Style         string          `json:"style,omitempty"`
+	Placeholder   *textObject     `json:"placeholder,omitempty"`
+	Options       []*optionObject `json:"options,omitempty"`
+	OptionGroups  []*optionGroup  `json:"option_groups,omitempty"`
+	InitialOption *optionObject   `json:"initial_option,omitempty"`
+	InitialValue  string          `json:"initial_value,omitempty"`
+	Multiline     bool            `json:"multiline,omitempty"`
+}
+
+// block is a layout block; only the fields of its type are set.
+type block struct {
+	Type    string      `json:"type"`
+	BlockID string      `json:"block_id,omitempty"`
+	Text    *textObject `json:"text,omitempty"`
+
+	// image
+	ImageURL string      `json:"image_url,omitempty"`
+	AltText  string      `json:"alt_text,omitempty"`
+	Title    *textObject `json:"title,omitempty"`
+
+	// actions and context (*blockElement or *textObject)
+	Elements []interface{} `json:"elements,omitempty"`
+
+	// input
+	Label   *textObject   `json:"label,omitempty"`
+	Element *blockElement `json:"element,omitempty"`
+}
+
+type modalView struct {
+	Type            string      `json:"type"` // "modal"
+	CallbackID      string      `json:"callback_id"`
+	Title           *textObject `json:"title"`
+	Submit          *textObject `json:"submit,omitempty"`
+	Close           *textObject `json:"close,omitempty"`
+	PrivateMetadata string      `json:"private_metadata,omitempty"`
+	Blocks          []block     `json:"blocks"`
+}
+
+// interactionPayload is the payload of the interactions with messages with
+// blocks (block_actions) and modals (view_submission).
+type interactionPayload struct {
+	Type      string `json:"type"`
+	TriggerID string `json:"trigger_id"`
+	User      struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	Actions []struct {
+		ActionID       string        `json:"action_id"`
+		BlockID        string        `json:"block_id"`
+		Value          string        `json:"value"`
+		SelectedOption *optionObject `json:"selected_option"`
+	} `json:"actions"`
+	View struct {
+		CallbackID      string `json:"callback_id"`
+		PrivateMetadata string `json:"private_metadata"`
+		State           struct {
+			// block_id -> action_id -> value
+			Values map[string]map[string]struct {
+				Value string `json:"value"`
+			} `json:"values"`
+		} `json:"state"`
+	} `json:"view"`
+}
+
+// slackAPI calls the methods of the Slack Web API that take JSON arguments.
+type slackAPI struct {
+	token string
+	url   string // base URL, for tests
+}
+
+func newSlackAPI(token string) *slackAPI {
+	return &slackAPI{token: token, url: "https://slack.com/api/"}
+}
+
+var slackAPIClient = &http.Client{Timeout: 10 * time.Second}
+
+// call invokes a method with the specified arguments, and decodes the
+// response into resp (if not nil).
+func (api *slackAPI) call(method string, args interface{}, resp interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		panic(err) // programming error, structure not marshalable
+	}
+	req, err := http.NewRequest("POST", api.url+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+api.token)
+
+	r, err := slackAPIClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, r.Status)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &status); err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+	if !status.OK {
+		return fmt.Errorf("%s: %s", method, status.Error)
+	}
+	if resp != nil {
+		return json.Unmarshal(raw, resp)
+	}
+	return nil
+}
+
+// postMessage posts a message with blocks, and returns its timestamp. text
+// is shown in notifications.
+func (api *slackAPI) postMessage(channel, text string, blocks []block) (string, error) {
+	var resp struct {
+		TS string `json:"ts"`
+	}
+	err := api.call("chat.postMessage", map[string]interface{}{
+		"channel": channel,
+		"text":    text,
+		"blocks":  blocks,
+	}, &resp)
+	return resp.TS, err
+}
+
+// updateMessage replaces the content of a message.
+func (api *slackAPI) updateMessage(channel, ts, text string, blocks []block) error {
+	return api.call("chat.update", map[string]interface{}{
+		"channel": channel,
+		"ts":      ts,
+		"text":    text,
+		"blocks":  blocks,
+	}, nil)
+}
+
+// openView opens a modal, in response to an interaction.
+func (api *slackAPI) openView(triggerID string, view *modalView) error {
+	return api.call("views.open", map[string]interface{}{
+		"trigger_id": triggerID,
+		"view":       view,
+	}, nil)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rasky/CryptoFaxPA/common"
+)
+
+// Device is a CryptoFaxPA known to the backend.
+type Device struct {
+	ID        string   `json:"id"`         // MQTT client ID of the device
+	Name      string   `json:"name"`       // display name shown in Slack
+	Owner     string   `json:"owner"`      // who's in charge of the device
+	PublicKey string   `json:"public_key"` // see faxkey
+	Groups    []string `json:"groups"`
+
+	key *common.Key
+}
+
+// Topic returns the MQTT topic the device receives faxes on.
+func (d *Device) Topic() string {
+	return common.FaxTopic(d.ID)
+}
+
+// Key returns the public key faxes for this device must be sealed with.
+func (d *Device) Key() *common.Key {
+	return d.key
+}
+
+// Targets are what the sender picks in Slack: either a single device or a
+// group of devices.
+const (
+	targetDevicePrefix = "device:"
+	targetGroupPrefix  = "group:"
+)
+
+// DeviceRegistry is the list of devices faxes can be sent to. It is
+// configured through the DEVICES environment variable, as a JSON list of
+// Device objects; the first device is the default target.
+type DeviceRegistry struct {
+	devices []*Device
+}
+
+// NewDeviceRegistry parses the JSON configuration of the registry.
+func NewDeviceRegistry(config string) (*DeviceRegistry, error) {
+	var devices []*Device
+	if err := json.Unmarshal([]byte(config), &devices); err != nil {
+		return nil, fmt.Errorf("invalid device registry: %v", err)
+	}
+	return newDeviceRegistry(devices)
+}
+
+func newDeviceRegistry(devices []*Device) (*DeviceRegistry, error) {
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("invalid device registry: no devices")
+	}
+
+	seen := make(map[string]bool)
+	for _, d := range devices {
+		if d.ID == "" || strings.ContainsAny(d.ID, "/+#") {
+			return nil, fmt.Errorf("invalid device ID: %q", d.ID)
+		}
+		if seen[d.ID] {
+			return nil, fmt.Errorf("duplicated device ID: %q", d.ID)
+		}
+		seen[d.ID] = true
+
+		key, err := common.ParseKey(d.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("device %s: %v", d.ID, err)
+		}
+		d.key = key
+		if d.Name == "" {
+			d.Name = d.ID
+		}
+	}
+	return &DeviceRegistry{devices: devices}, nil
+}
+
+func (r *DeviceRegistry) Devices() []*Device {
+	return r.devices
+}
+
+func (r *DeviceRegistry) Device(id string) *Device {
+	for _, d := range r.devices {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// Groups returns the sorted list of all groups.
+func (r *DeviceRegistry) Groups() []string {
+	seen := make(map[string]bool)
+	var groups []string
+	for _, d := range r.devices {
+		for _, g := range d.Groups {
+			if !seen[g] {
+				groups = append(groups, g)
+				seen[g] = true
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// DefaultTarget is the target used when the sender doesn't pick one.
+func (r *DeviceRegistry) DefaultTarget() string {
+	return targetDevicePrefix + r.devices[0].ID
+}
+
+// Resolve returns the list of devices a target refers to.
+func (r *DeviceRegistry) Resolve(target string) ([]*Device, error) {
+	switch {
+	case strings.HasPrefix(target, targetDevicePrefix):
+		if d := r.Device(strings.TrimPrefix(target, targetDevicePrefix)); d != nil {
+			return []*Device{d}, nil
+		}
+	case strings.HasPrefix(target, targetGroupPrefix):
+		group := strings.TrimPrefix(target, targetGroupPrefix)
+		var devices []*Device
+		for _, d := range r.devices {
+			for _, g := range d.Groups {
+				if g == group {
+					devices = append(devices, d)
+					break
+				}
+			}
+		}
+		if len(devices) != 0 {
+			return devices, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown target: %q", target)
+}
+
+// TargetName returns a human-readable description of a target.
+func (r *DeviceRegistry) TargetName(target string) string {
+	if strings.HasPrefix(target, targetGroupPrefix) {
+		return "group " + strings.TrimPrefix(target, targetGroupPrefix)
+	}
+	if d := r.Device(strings.TrimPrefix(target, targetDevicePrefix)); d != nil {
+		return d.Name
+	}
+	return target
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"image/png"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/rasky/CryptoFaxPA/common"
+)
+
+// faxDraft is a fax waiting for the confirmation of the sender, who can
+// still edit its text and pick its options.
+type faxDraft struct {
+	ID        string
+	Channel   string
+	MessageTs string // of the confirmation message
+	Sender    string
+	Text      string
+	Image     string // GUID of the picture in the cache, if any
+	Options   faxOptions
+	Preview   int // revision of the preview, see previewKey
+}
+
+// faxOptions are the options picked by the sender before confirming a fax.
+type faxOptions struct {
+	Target string // see DeviceRegistry.Resolve
+	Render string // renderAuto, renderText or renderImage
+	Size   string // sizeSmall, sizeNormal or sizeLarge
+	Image  string // image preset, see ConvertImageMono
+}
+
+const (
+	renderAuto  = "auto"  // render only if the printer font is not enough
+	renderText  = "text"  // always use the printer font
+	renderImage = "image" // always render with TextRenderer
+)
+
+// Sizes of the text rendered with TextRenderer. The printer font has a single
+// size, so picking a size other than sizeNormal renders the text (unless the
+// sender asked for the printer font).
+const (
+	sizeSmall  = "small"
+	sizeNormal = "normal"
+	sizeLarge  = "large"
+)
+
+// FontSizes are the sizes of the text renderers, in printer dots.
+var FontSizes = map[string]float64{
+	sizeSmall:  18,
+	sizeNormal: 24,
+	sizeLarge:  36,
+}
+
+// Drafts are kept for a day (arbitrary); previews as long as the images,
+// since they're shown in the message after the fax is sent.
+const (
+	draftExpiration   = 24 * time.Hour
+	previewExpiration = 30 * 24 * time.Hour
+)
+
+// A draft is locked while a change is applied (see FaxComposer.lock). The
+// lock expires by itself, in case a dyno dies while holding it.
+const (
+	draftLockExpiration = 30 * time.Second
+	draftLockTimeout    = 2 * time.Second
+)
+
+// newGUID returns a random identifier.
+func newGUID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("error acquiring random: %v", err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// FaxComposer manages the drafts of the faxes and their confirmation
+// messages: each change to a draft updates the preview, which is the fax
+// printed on a virtual printer.
+type FaxComposer struct {
+	api       *slackAPI
+	cache     *ImageCache
+	devices   *DeviceRegistry
+	presence  *PresenceTracker
+	renderers map[string]*TextRenderer // by size
+}
+
+func draftKey(id string) string {
+	return "/draft/" + id
+}
+
+// previewKey is the cache key of the preview; it's also its URL, served as
+// the other images. Each revision has its own URL, so that Slack doesn't
+// show a stale preview.
+func previewKey(d *faxDraft) string {
+	return fmt.Sprintf("/image/preview/%s/%d", d.ID, d.Preview)
+}
+
+// Start creates a draft and asks the sender to confirm it. image is the
+// GUID of a picture converted by the listener, if any.
+func (c *FaxComposer) Start(channel, sender, text, image string) error {
+	id, err := newGUID()
+	if err != nil {
+		return err
+	}
+	d := &faxDraft{
+		ID:      id,
+		Channel: channel,
+		Sender:  sender,
+		Text:    text,
+		Image:   image,
+		Options: faxOptions{
+			Target: c.devices.DefaultTarget(),
+			Render: renderAuto,
+			Size:   sizeNormal,
+			Image:  imageAuto,
+		},
+	}
+	if err := c.preview(d); err != nil {
+		return err
+	}
+
+	d.MessageTs, err = c.api.postMessage(channel, "Confirm sending this fax", c.confirmBlocks(d))
+	if err != nil {
+		return fmt.Errorf("failed to post message: %v", err)
+	}
+	return c.cache.Set(draftKey(d.ID), d, draftExpiration)
+}
+
+// lock waits until nobody else is changing a draft, and locks it: changes
+// are loaded, applied and saved under the lock, otherwise a change made at
+// the same time (eg: two menus picked in a row) would be lost. The lock is
+// in Redis, since the interactions might reach different dynos. It returns
+// the function that unlocks the draft.
+func (c *FaxComposer) lock(id string) (func(), error) {
+	key := "/lock" + draftKey(id)
+	token, err := newGUID()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(draftLockTimeout)
+	for {
+		locked, err := c.cache.TryLock(key, token, draftLockExpiration)
+		if err != nil {
+			return nil, fmt.Errorf("cannot lock draft %s: %v", id, err)
+		}
+		if locked {
+			return func() {
+				if err := c.cache.Unlock(key, token); err != nil {
+					log.Printf("[ERROR] cannot unlock draft %s: %v", id, err)
+				}
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout while waiting for draft %s", id)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Change applies a change of the sender to a draft, and refreshes the
+// preview in its confirmation message.
+func (c *FaxComposer) Change(id string, change func(d *faxDraft)) error {
+	unlock, err := c.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d, err := c.Load(id)
+	if err != nil {
+		return err
+	}
+	change(d)
+	return c.Update(d)
+}
+
+// Take removes a draft that is going to be sent or canceled, so that the
+// changes made in the meantime find it expired (and sending it twice is not
+// possible). The draft is not locked while it's sent, which might take long.
+func (c *FaxComposer) Take(id string) (*faxDraft, error) {
+	unlock, err := c.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	d, err := c.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.cache.Del(draftKey(id)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Restore puts back a draft that could not be sent, so that the sender can
+// try again.
+func (c *FaxComposer) Restore(d *faxDraft) error {
+	return c.cache.Set(draftKey(d.ID), d, draftExpiration)
+}
+
+// Load returns a draft that is still waiting for confirmation.
+func (c *FaxComposer) Load(id string) (*faxDraft, error) {
+	var d faxDraft
+	if err := c.cache.Get(draftKey(id), &d); err != nil {
+		return nil, fmt.Errorf("draft %s expired", id)
+	}
+	return &d, nil
+}
+
+// Update saves a draft changed by the sender, and refreshes the preview in
+// its confirmation message. The draft must be locked (see Change).
+func (c *FaxComposer) Update(d *faxDraft) error {
+	if err := c.preview(d); err != nil {
+		return err
+	}
+	if err := c.cache.Set(draftKey(d.ID), d, draftExpiration); err != nil {
+		return err
+	}
+	return c.api.updateMessage(d.Channel, d.MessageTs, "Confirm sending this fax", c.confirmBlocks(d))
+}
+
+// Close forgets a draft, once it was sent or canceled, and replaces the
+// confirmation message with blocks.
+func (c *FaxComposer) Close(d *faxDraft, text string, blocks []block) error {
+	c.cache.Del(draftKey(d.ID))
+	c.cache.Del("/channel/" + d.Channel) // use images once only
+	return c.api.updateMessage(d.Channel, d.MessageTs, text, blocks)
+}
+
+// Fax creates the fax for a draft, rendering its text and converting its
+// picture as picked by the sender.
+func (c *FaxComposer) Fax(d *faxDraft, now time.Time) (*common.Fax, error) {
+	fax := &common.Fax{
+		Sender:    d.Sender,
+		Timestamp: now,
+		Message:   d.Text,
+	}
+
+	// Render the text on our side if the printer font can't print it
+	opts := d.Options
+	render := opts.Render == renderImage ||
+		(opts.Render == renderAuto && (opts.Size != sizeNormal || !common.CanEncodeForPrinter(fax.Message)))
+	if render {
+		renderer := c.renderers[opts.Size]
+		if renderer == nil {
+			renderer = c.renderers[sizeNormal]
+		}
+		var err error
+		if fax.RenderedMessage, err = renderer.Render(fax.Message); err != nil {
+			log.Printf("[ERROR] cannot render message, sending it as text: %v", err)
+		}
+	}
+
+	if d.Image != "" {
+		var err error
+		if fax.Picture, err = c.picture(d.Image, opts.Image); err != nil {
+			return nil, err
+		}
+	}
+	return fax, nil
+}
+
+// picture returns the picture with the specified GUID, converted with a
+// preset. Conversions are cached along with the picture.
+func (c *FaxComposer) picture(guid, preset string) ([]byte, error) {
+	key := "/image/" + guid
+	if preset != imageAuto {
+		key += "/" + preset
+	}
+
+	var img []byte
+	if c.cache.Get(key, &img) == nil {
+		return img, nil
+	}
+	var src []byte
+	if err := c.cache.Get("/source/"+guid, &src); err != nil {
+		return nil, fmt.Errorf("image %s expired", guid)
+	}
+	img, err := ConvertImageMono(src, preset)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Set(key, img, 30*24*time.Hour)
+	return img, nil
+}
+
+// preview prints the fax on a virtual printer, and saves the paper as a new
+// revision of the preview of the draft.
+func (c *FaxComposer) preview(d *faxDraft) error {
+	fax, err := c.Fax(d, time.Now())
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, common.PreviewFax(fax)); err != nil {
+		return err
+	}
+	d.Preview++
+	return c.cache.Set(previewKey(d), buf.Bytes(), previewExpiration)
+}
+
+func previewBlock(d *faxDraft) block {
+	return block{
+		Type:     "image",
+		ImageURL: env.ServerUrl + previewKey(d),
+		AltText:  "Preview of the fax",
+		Title:    plainText("Preview"),
+	}
+}
+
+// Blocks of the confirmation message carry the ID of the draft, so that
+// interactions can find it.
+const (
+	blockOptions = "options/"
+	blockConfirm = "confirm/"
+)
+
+// draftID returns the ID of the draft of an interaction with a block.
+func draftID(blockID string) string {
+	return blockID[strings.Index(blockID, "/")+1:]
+}
+
+// confirmBlocks builds the confirmation message of a draft: the preview, the
+// menus to pick the options, and the buttons to edit, send or cancel it.
+func (c *FaxComposer) confirmBlocks(d *faxDraft) []block {
+	pretext := "Confirm sending this text to Cryptofax? :fax:"
+	if targets, err := c.devices.Resolve(d.Options.Target); err == nil {
+		pretext = confirmPretext(targets, c.presence)
+	}
+
+	// Let the sender pick how to print the text and the destination, if
+	// there's more than one
+	var menus []interface{}
+	if len(c.devices.Devices()) > 1 {
+		menus = append(menus, targetMenu(c.devices, d.Options.Target))
+	}
+	menus = append(menus, renderMenu(d.Options.Render), sizeMenu(d.Options.Size))
+	if d.Image != "" {
+		menus = append(menus, imageMenu(d.Options.Image))
+	}
+
+	return []block{
+		{Type: "section", Text: mrkdwnText(pretext)},
+		previewBlock(d),
+		{Type: "actions", BlockID: blockOptions + d.ID, Elements: menus},
+		{Type: "actions", BlockID: blockConfirm + d.ID, Elements: []interface{}{
+			&blockElement{
+				Type:     "button",
+				ActionID: actionStart,
+				Text:     plainText("Fax it :fax:"),
+				Style:    "primary",
+			},
+			&blockElement{
+				Type:     "button",
+				ActionID: actionEdit,
+				Text:     plainText("Edit text"),
+			},
+			&blockElement{
+				Type:     "button",
+				ActionID: actionCancel,
+				Text:     plainText("No"),
+				Style:    "danger",
+			},
+		}},
+	}
+}
+
+// statusBlocks builds the message of a fax that was sent: the preview and
+// the delivery status.
+func statusBlocks(d *faxDraft, rec *faxRecord) []block {
+	blocks := []block{previewBlock(d)}
+	for _, f := range rec.Fields() {
+		text := f.Title
+		if f.Value != "" {
+			text += "\n" + f.Value
+		}
+		blocks = append(blocks, block{Type: "section", Text: mrkdwnText(text)})
+	}
+	return blocks
+}
+
+// canceledBlocks builds the message of a draft that was canceled.
+func canceledBlocks(d *faxDraft) []block {
+	return []block{
+		{Type: "section", Text: mrkdwnText(":x: request canceled")},
+		{Type: "context", Elements: []interface{}{mrkdwnText(">" + strings.Replace(d.Text, "\n", "\n>", -1))}},
+	}
+}
+
+// editView builds the modal used to edit the text of a draft.
+func editView(d *faxDraft) *modalView {
+	return &modalView{
+		Type:            "modal",
+		CallbackID:      actionEdit,
+		Title:           plainText("Edit fax"),
+		Submit:          plainText("Preview"),
+		Close:           plainText("Cancel"),
+		PrivateMetadata: d.ID,
+		Blocks: []block{
+			{
+				Type:    "input",
+				BlockID: actionEdit,
+				Label:   plainText("Text"),
+				Element: &blockElement{
+					Type:         "plain_text_input",
+					ActionID:     actionEdit,
+					InitialValue: d.Text,
+					Multiline:    true,
+				},
+			},
+		},
+	}
+}
+
+// selectMenu builds a menu with the specified options, showing the one with
+// value selected.
+func selectMenu(action, placeholder, selected string, opts []*optionObject) *blockElement {
+	menu := &blockElement{
+		Type:        "static_select",
+		ActionID:    action,
+		Placeholder: plainText(placeholder),
+		Options:     opts,
+	}
+	for _, o := range opts {
+		if o.Value == selected {
+			menu.InitialOption = o
+		}
+	}
+	return menu
+}
+
+func option(text, value, description string) *optionObject {
+	o := &optionObject{Text: plainText(text), Value: value}
+	if description != "" {
+		o.Description = plainText(description)
+	}
+	return o
+}
+
+// targetMenu builds the menu used to pick which devices to send a fax to.
+func targetMenu(devices *DeviceRegistry, selected string) *blockElement {
+	var devopts, groupopts []*optionObject
+	for _, d := range devices.Devices() {
+		devopts = append(devopts, option(d.Name, targetDevicePrefix+d.ID, d.Owner))
+	}
+	for _, g := range devices.Groups() {
+		groupopts = append(groupopts, option("All devices in "+g, targetGroupPrefix+g, ""))
+	}
+
+	menu := selectMenu(actionTarget, "Send to...", selected, append(devopts, groupopts...))
+	if len(groupopts) != 0 {
+		menu.Options = nil
+		menu.OptionGroups = []*optionGroup{
+			{Label: plainText("Devices"), Options: devopts},
+			{Label: plainText("Groups"), Options: groupopts},
+		}
+	}
+	return menu
+}
+
+// validOption returns true if value is one of the choices of the render,
+// size or image menu (action): anything else would break the draft.
+func validOption(action, value string) bool {
+	switch action {
+	case actionRender:
+		return value == renderAuto || value == renderText || value == renderImage
+	case actionSize:
+		_, found := FontSizes[value]
+		return found
+	case actionImage:
+		switch value {
+		case imageAuto, imagePhoto, imageScreenshot, imageDrawing, imageHalftone:
+			return true
+		}
+	}
+	return false
+}
+
+// renderMenu builds the menu used to pick how the text is printed.
+func renderMenu(selected string) *blockElement {
+	return selectMenu(actionRender, "Font...", selected, []*optionObject{
+		option("Auto", renderAuto, "Printer font, unless there are special characters"),
+		option("Printer font", renderText, ""),
+		option("Unicode", renderImage, "Rendered as an image, supports any language and emoji"),
+	})
+}
+
+// sizeMenu builds the menu used to pick the size of the text.
+func sizeMenu(selected string) *blockElement {
+	return selectMenu(actionSize, "Size...", selected, []*optionObject{
+		option("Small text", sizeSmall, "Rendered as an image"),
+		option("Normal text", sizeNormal, ""),
+		option("Large text", sizeLarge, "Rendered as an image"),
+	})
+}
+
+// imageMenu builds the menu used to pick how the picture is converted to
+// black & white.
+func imageMenu(selected string) *blockElement {
+	return selectMenu(actionImage, "Image...", selected, []*optionObject{
+		option("Auto", imageAuto, ""),
+		option("Photo", imagePhoto, "Stucki dithering, with contrast and sharpening"),
+		option("Screenshot", imageScreenshot, "Atkinson dithering, keeps text crisp"),
+		option("Drawing", imageDrawing, "Black & white, no dithering"),
+		option("Halftone", imageHalftone, "Ordered dithering, like old newspapers"),
+	})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/rasky/CryptoFaxPA/common"
+)
+
+func TestConfirmBlocks(t *testing.T) {
+	kp, err := common.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := newDeviceRegistry([]*Device{
+		{ID: "diego", Name: "Diego's desk", PublicKey: kp.Public.String(), Groups: []string{"team"}},
+		{ID: "office", PublicKey: kp.Public.String(), Groups: []string{"team"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &FaxComposer{devices: devices, presence: NewPresenceTracker()}
+	d := &faxDraft{
+		ID:   "0123",
+		Text: "Ciao!",
+		Options: faxOptions{
+			Target: targetGroupPrefix + "team",
+			Render: renderAuto,
+			Size:   sizeLarge,
+			Image:  imageAuto,
+		},
+	}
+
+	menus := func(blocks []block) map[string]*blockElement {
+		m := make(map[string]*blockElement)
+		for _, b := range blocks {
+			if b.BlockID == "" {
+				continue
+			}
+			if id := draftID(b.BlockID); id != d.ID {
+				t.Errorf("%s: invalid draft ID: %q", b.BlockID, id)
+			}
+			for _, e := range b.Elements {
+				e := e.(*blockElement)
+				m[e.ActionID] = e
+			}
+		}
+		return m
+	}
+
+	m := menus(c.confirmBlocks(d))
+	for _, action := range []string{actionTarget, actionRender, actionSize, actionStart, actionEdit, actionCancel} {
+		if m[action] == nil {
+			t.Errorf("%s: missing element", action)
+		}
+	}
+	if m[actionImage] != nil {
+		t.Errorf("image menu shown without a picture")
+	}
+	for action, value := range map[string]string{
+		actionTarget: d.Options.Target,
+		actionRender: d.Options.Render,
+		actionSize:   d.Options.Size,
+	} {
+		if e := m[action]; e != nil && (e.InitialOption == nil || e.InitialOption.Value != value) {
+			t.Errorf("%s: invalid selection: %+v", action, e.InitialOption)
+		}
+	}
+
+	// With groups, the option groups replace the options
+	if len(m[actionTarget].OptionGroups) != 2 || len(m[actionTarget].Options) != 0 {
+		t.Errorf("invalid target menu: %+v", m[actionTarget])
+	}
+
+	d.Image = "guid"
+	m = menus(c.confirmBlocks(d))
+	if m[actionImage] == nil {
+		t.Fatalf("missing image menu")
+	}
+
+	// Every choice of the menus is valid, and nothing else
+	for _, action := range []string{actionRender, actionSize, actionImage} {
+		for _, o := range m[action].Options {
+			if !validOption(action, o.Value) {
+				t.Errorf("%s: option %q refused", action, o.Value)
+			}
+		}
+		for _, value := range []string{"", "bogus", "team"} {
+			if validOption(action, value) {
+				t.Errorf("%s: invalid option %q accepted", action, value)
+			}
+		}
+	}
+}
+
+func TestDraftFax(t *testing.T) {
+	c := &FaxComposer{renderers: make(map[string]*TextRenderer)}
+	for size, dots := range FontSizes {
+		r, err := NewTextRenderer(dots, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.renderers[size] = r
+	}
+
+	var tests = []struct {
+		text     string
+		render   string
+		size     string
+		rendered bool
+	}{
+		{"Ciao!", renderAuto, sizeNormal, false},
+		{"Ciao! \u2603", renderAuto, sizeNormal, true},
+		{"Ciao!", renderAuto, sizeLarge, true},
+		{"Ciao!", renderAuto, sizeSmall, true},
+		{"Ciao!", renderText, sizeLarge, false},
+		{"Ciao!", renderImage, sizeNormal, true},
+	}
+
+	for _, tc := range tests {
+		d := &faxDraft{Sender: "Diego", Text: tc.text, Options: faxOptions{Render: tc.render, Size: tc.size}}
+		fax, err := c.Fax(d, time.Now())
+		if err != nil {
+			t.Errorf("%s/%s: %v", tc.render, tc.size, err)
+			continue
+		}
+		if fax.Message != tc.text || fax.Sender != "Diego" {
+			t.Errorf("%s/%s: invalid fax: %+v", tc.render, tc.size, fax)
+		}
+		if rendered := len(fax.RenderedMessage) != 0; rendered != tc.rendered {
+			t.Errorf("%q %s/%s: rendered=%v, exp %v", tc.text, tc.render, tc.size, rendered, tc.rendered)
+		}
+	}
+
+	// Larger text takes more paper
+	d := &faxDraft{Text: "Ciao!", Options: faxOptions{Render: renderImage, Size: sizeSmall}}
+	small, err := c.Fax(d, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Options.Size = sizeLarge
+	large, err := c.Fax(d, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs, hl := common.PreviewFax(small).Bounds().Dy(), common.PreviewFax(large).Bounds().Dy(); hs >= hl {
+		t.Errorf("large text is not larger: %d >= %d", hs, hl)
+	}
+}
+
+func TestInteractionPayload(t *testing.T) {
+	// Payloads recorded from Slack (shortened)
+	var tests = []struct {
+		json   string
+		action string
+		block  string
+		value  string
+	}{
+		{
+			`{"type":"block_actions","user":{"id":"U2CERLKJA"},"trigger_id":"398738663015.47445629121","actions":[{"type":"static_select","action_id":"size","block_id":"options/0123","selected_option":{"text":{"type":"plain_text","text":"Large text","emoji":true},"value":"large"},"action_ts":"1548426417.840180"}]}`,
+			actionSize, "options/0123", sizeLarge,
+		},
+		{
+			`{"type":"block_actions","user":{"id":"U2CERLKJA"},"trigger_id":"398738663015.47445629121","actions":[{"type":"button","action_id":"edit","block_id":"confirm/0123","text":{"type":"plain_text","text":"Edit text","emoji":true},"action_ts":"1548426417.840180"}]}`,
+			actionEdit, "confirm/0123", "",
+		},
+		{
+			`{"type":"view_submission","user":{"id":"U2CERLKJA"},"view":{"id":"VNHU13V36","type":"modal","callback_id":"edit","private_metadata":"0123","state":{"values":{"edit":{"edit":{"type":"plain_text_input","value":"Ciao\nteam!"}}}}}}`,
+			"", "", "Ciao\nteam!",
+		},
+	}
+
+	for _, tc := range tests {
+		var p interactionPayload
+		if err := json.Unmarshal([]byte(tc.json), &p); err != nil {
+			t.Errorf("%s: %v", tc.json, err)
+			continue
+		}
+		switch p.Type {
+		case "block_actions":
+			if len(p.Actions) != 1 {
+				t.Errorf("%s: invalid actions: %+v", p.Type, p.Actions)
+				continue
+			}
+			a := p.Actions[0]
+			if a.ActionID != tc.action || a.BlockID != tc.block || draftID(a.BlockID) != "0123" {
+				t.Errorf("%s: invalid action: %+v", tc.action, a)
+			}
+			if tc.value != "" && (a.SelectedOption == nil || a.SelectedOption.Value != tc.value) {
+				t.Errorf("%s: invalid selection: %+v", tc.action, a.SelectedOption)
+			}
+		case "view_submission":
+			if p.View.CallbackID != actionEdit || p.View.PrivateMetadata != "0123" {
+				t.Errorf("invalid view: %+v", p.View)
+			}
+			if v := p.View.State.Values[actionEdit][actionEdit].Value; v != tc.value {
+				t.Errorf("invalid text: %q", v)
+			}
+		}
+	}
+}
+
+// postInteraction posts an interaction payload to a handler without a
+// backend, so it must be answered before touching any draft.
+func postInteraction(payload string) *httptest.ResponseRecorder {
+	form := url.Values{"payload": {payload}}
+	r := httptest.NewRequest("POST", "/interaction", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	interactionHandler{}.ServeHTTP(w, r)
+	return w
+}
+
+func TestInvalidInteraction(t *testing.T) {
+	var tests = []struct {
+		payload string
+		status  int
+	}{
+		{`{"type":"block_actions","actions":[]}`, http.StatusBadRequest},
+		{`{"type":"block_actions","actions":[{"action_id":"render","block_id":"options/0123","selected_option":{"value":"comic-sans"}}]}`, http.StatusBadRequest},
+		{`{"type":"block_actions","actions":[{"action_id":"size","block_id":"options/0123","selected_option":{"value":"huge"}}]}`, http.StatusBadRequest},
+		{`{"type":"block_actions","actions":[{"action_id":"image","block_id":"options/0123","selected_option":{"value":"sepia"}}]}`, http.StatusBadRequest},
+		{`{"type":"block_actions","actions":[{"action_id":"size","block_id":"options/0123"}]}`, http.StatusBadRequest},
+		{`{"type":"block_actions","actions":[{"action_id":"print","block_id":"confirm/0123"}]}`, http.StatusBadRequest},
+		{`{"type":"view_submission","view":{"callback_id":"other","private_metadata":"0123"}}`, http.StatusBadRequest},
+		{`{"type":"message_action"}`, http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		if w := postInteraction(tc.payload); w.Code != tc.status {
+			t.Errorf("%s: got %d, exp %d", tc.payload, w.Code, tc.status)
+		}
+	}
+
+	// An empty text is refused in the modal, which stays open
+	w := postInteraction(`{"type":"view_submission","view":{"callback_id":"edit","private_metadata":"0123","state":{"values":{"edit":{"edit":{"value":" \n"}}}}}}`)
+	var resp struct {
+		ResponseAction string            `json:"response_action"`
+		Errors         map[string]string `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.ResponseAction != "errors" || resp.Errors[actionEdit] == "" {
+		t.Errorf("empty text accepted: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestLegacyInteraction(t *testing.T) {
+	// A button of a confirmation message sent before Block Kit (shortened)
+	payload := `{"type":"interactive_message","actions":[{"name":"start","type":"button","value":"start"}],"callback_id":"fax","original_message":{"type":"message","text":"","attachments":[{"pretext":"Confirm sending this text to Cryptofax? :fax:","author_name":"Diego","text":"Ciao!","actions":[{"name":"start","text":"Send","type":"button","value":"start"},{"name":"cancel","text":"Cancel","type":"button","value":"cancel"}]}]}}`
+	w := postInteraction(payload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("invalid status: %d", w.Code)
+	}
+	var msg slack.Message
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Text != "Ciao!" {
+		t.Fatalf("original message not kept: %+v", msg)
+	}
+	if a := msg.Attachments[0]; len(a.Actions) != 0 || len(a.Fields) != 1 || !strings.Contains(a.Fields[0].Title, "send the fax again") {
+		t.Errorf("invalid answer: %+v", a)
+	}
+}
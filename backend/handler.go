@@ -1,25 +1,31 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"errors"
 	"log"
 	"net/http"
-	"net/url"
+	"strings"
 	"time"
 
 	"github.com/rasky/CryptoFaxPA/common"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/nlopes/slack"
-	"github.com/vmihailenco/msgpack"
 )
 
-// interactionHandler handles interactive message response.
+var errTimeout = errors.New("timeout while waiting for cloudmqtt")
+
+// interactionHandler handles the interactions with the confirmation messages
+// and the modal used to edit the text.
 type interactionHandler struct {
-	slackClient       *slack.Client
-	imgcache          *ImageCache
-	verificationToken string
+	api        *slackAPI
+	composer   *FaxComposer
+	mqttClient mqtt.Client
+	tracker    *FaxTracker
+	devices    *DeviceRegistry
 }
 
 func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -29,103 +35,258 @@ func (h interactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buf, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("[ERROR] Failed to read request body: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	// The request was already authenticated by its signature (see
+	// verifySlackRequests); the callback is in the "payload" form field
+	jsonStr := r.PostFormValue("payload")
+	if jsonStr == "" {
+		log.Printf("[ERROR] Missing payload in request")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	jsonStr, err := url.QueryUnescape(string(buf)[8:])
-	if err != nil {
-		log.Printf("[ERROR] Failed to unespace request body: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	var payload interactionPayload
+	if err := json.Unmarshal([]byte(jsonStr), &payload); err != nil {
+		log.Printf("[ERROR] Failed to decode json message from slack: %s", jsonStr)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	var message slack.AttachmentActionCallback
-	if err := json.Unmarshal([]byte(jsonStr), &message); err != nil {
-		log.Printf("[ERROR] Failed to decode json message from slack: %s", jsonStr)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	switch payload.Type {
+	case "block_actions":
+		h.handleAction(w, &payload)
+	case "view_submission":
+		h.handleSubmission(w, &payload)
+	case "interactive_message":
+		handleLegacyMessage(w, jsonStr)
+	default:
+		log.Printf("[ERROR] Invalid interaction: %s", payload.Type)
+		w.WriteHeader(http.StatusBadRequest)
 	}
+}
 
-	// Only accept message from slack with valid token
-	if message.Token != h.verificationToken {
-		log.Printf("[ERROR] Invalid token: %s", message.Token)
-		w.WriteHeader(http.StatusUnauthorized)
+// handleAction handles the buttons and menus of a confirmation message. The
+// message is updated through the API, since Slack ignores the response.
+// Slack wants an answer within 3 seconds, so the action is checked right
+// away, but updating the draft and sending the fax is done in background.
+func (h interactionHandler) handleAction(w http.ResponseWriter, payload *interactionPayload) {
+	if len(payload.Actions) == 0 {
+		log.Printf("[ERROR] No action submitted")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	action := message.Actions[0]
+	action := payload.Actions[0]
 	log.Printf("INTERACTION ACTION: %#v", action)
-	switch action.Name {
-	case actionStart:
+	id := draftID(action.BlockID)
 
-		fax := common.Fax{
-			Sender:    message.OriginalMessage.Attachments[0].AuthorName,
-			Timestamp: time.Now(),
-			Message:   action.Value,
+	switch action.ActionID {
+	case actionTarget, actionRender, actionSize, actionImage:
+		// Remember the options picked by the sender, and show the new preview
+		if action.SelectedOption == nil {
+			log.Printf("[ERROR] No option selected")
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-
-		// See if there was a picture
-		imageurl := message.OriginalMessage.Attachments[0].ImageURL
-		if imageurl != "" {
-			if resp, err := http.Get(imageurl); err == nil {
-				fax.Picture, _ = ioutil.ReadAll(resp.Body)
-				resp.Body.Close()
+		value := action.SelectedOption.Value
+		if action.ActionID == actionTarget {
+			if _, err := h.devices.Resolve(value); err != nil {
+				log.Printf("[ERROR] %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
 			}
+		} else if !validOption(action.ActionID, value) {
+			log.Printf("[ERROR] Invalid %s option: %q", action.ActionID, value)
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-
-		// Try to send a message to CloudMQTT
-		mqtt, err := common.NewMqttClient("backend", env.MqttUrl)
+		go func() {
+			err := h.composer.Change(id, func(d *faxDraft) {
+				switch action.ActionID {
+				case actionTarget:
+					d.Options.Target = value
+				case actionRender:
+					d.Options.Render = value
+				case actionSize:
+					d.Options.Size = value
+				case actionImage:
+					d.Options.Image = value
+				}
+			})
+			if err != nil {
+				log.Printf("[ERROR] cannot update draft %s: %v", id, err)
+			}
+		}()
+	case actionEdit:
+		// The modal must be opened while the trigger is valid (3 seconds)
+		d, err := h.composer.Load(id)
 		if err != nil {
 			log.Printf("[ERROR] %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		defer mqtt.Disconnect(0)
-		payload, err := msgpack.Marshal(&fax)
-		if err != nil {
-			panic(err) // programming error, structure not marshalable
-		}
-
-		token := mqtt.Publish(common.FaxMqttTopic, 2, false, payload)
-		if !token.WaitTimeout(5 * time.Second) {
-			log.Printf("[ERROR] timeout while publishing to cloudmqtt")
+		if err := h.api.openView(payload.TriggerID, editView(d)); err != nil {
+			log.Printf("[ERROR] cannot open editor for draft %s: %v", d.ID, err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-
-		h.imgcache.Del("/channel/" + message.Channel.ID) // use images once only
-		title := ":ok: your fax has been encrypted and transmitted!"
-		responseMessage(w, message.OriginalMessage, title, "")
-		return
+	case actionStart:
+		go func() {
+			d, err := h.composer.Take(id)
+			if err != nil {
+				log.Printf("[ERROR] cannot send draft %s: %v", id, err)
+				return
+			}
+			if err := h.send(d); err != nil {
+				log.Printf("[ERROR] cannot send draft %s: %v", id, err)
+				if err := h.composer.Restore(d); err != nil {
+					log.Printf("[ERROR] cannot restore draft %s: %v", id, err)
+				}
+			}
+		}()
 	case actionCancel:
-		h.imgcache.Del("/channel/" + message.Channel.ID) // use images once only
-		title := fmt.Sprintf(":x: request canceled")
-		responseMessage(w, message.OriginalMessage, title, "")
-		return
+		go func() {
+			d, err := h.composer.Take(id)
+			if err == nil {
+				err = h.composer.Close(d, "Request canceled", canceledBlocks(d))
+			}
+			if err != nil {
+				log.Printf("[ERROR] cannot cancel draft %s: %v", id, err)
+			}
+		}()
 	default:
-		log.Printf("[ERROR] Invalid action was submitted: %s", action.Name)
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("[ERROR] Invalid action was submitted: %s", action.ActionID)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
 }
 
-// responseMessage response to the original slackbutton enabled message.
-// It removes button and replace it with message which indicate how bot will work
-func responseMessage(w http.ResponseWriter, original slack.Message, title, value string) {
-	original.Attachments[0].Actions = []slack.AttachmentAction{} // empty buttons
-	original.Attachments[0].Fields = []slack.AttachmentField{
-		{
-			Title: title,
-			Value: value,
-			Short: false,
-		},
+// handleSubmission handles the modal used to edit the text of a draft. The
+// modal is closed right away by an empty response, since Slack wants it
+// within 3 seconds; the preview is updated in background.
+func (h interactionHandler) handleSubmission(w http.ResponseWriter, payload *interactionPayload) {
+	if payload.View.CallbackID != actionEdit {
+		log.Printf("[ERROR] Invalid view was submitted: %s", payload.View.CallbackID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	text := strings.TrimSpace(payload.View.State.Values[actionEdit][actionEdit].Value)
+	if text == "" {
+		w.Header().Add("Content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"response_action": "errors",
+			"errors":          map[string]string{actionEdit: "The fax can't be empty"},
+		})
+		return
 	}
 
+	id := payload.View.PrivateMetadata
+	go func() {
+		if err := h.composer.Change(id, func(d *faxDraft) { d.Text = text }); err != nil {
+			log.Printf("[ERROR] cannot update draft %s: %v", id, err)
+		}
+	}()
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleLegacyMessage answers the buttons of the confirmation messages sent
+// before Block Kit, whose options were not saved as drafts: the message is
+// replaced with a request to send the fax again.
+func handleLegacyMessage(w http.ResponseWriter, jsonStr string) {
+	var message slack.AttachmentActionCallback
+	if err := json.Unmarshal([]byte(jsonStr), &message); err != nil {
+		log.Printf("[ERROR] Failed to decode json message from slack: %s", jsonStr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	original := message.OriginalMessage
+	for i := range original.Attachments {
+		original.Attachments[i].Actions = []slack.AttachmentAction{} // empty buttons
+	}
+	if len(original.Attachments) == 0 {
+		original.Attachments = []slack.Attachment{{}}
+	}
+	original.Attachments[0].Fields = []slack.AttachmentField{
+		{Title: "This request has expired: please send the fax again"},
+	}
 	w.Header().Add("Content-type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(&original)
 }
+
+// send sends a confirmed draft to its devices, and starts tracking it.
+func (h interactionHandler) send(d *faxDraft) error {
+	devices, err := h.devices.Resolve(d.Options.Target)
+	if err != nil {
+		return err
+	}
+
+	fax, err := h.composer.Fax(d, time.Now())
+	if err != nil {
+		return err
+	}
+	env, err := common.NewFaxEnvelope(fax)
+	if err != nil {
+		panic(err) // programming error, structure not marshalable
+	}
+	env.ID = faxID(d.Channel, d.MessageTs)
+	payload, err := env.Marshal()
+	if err != nil {
+		panic(err) // programming error, structure not marshalable
+	}
+
+	// Send the same envelope to all devices, so that they share the
+	// message ID; receipts are told apart by device.
+	rec := &faxRecord{
+		Channel:   d.Channel,
+		MessageTs: d.MessageTs,
+		Draft:     d,
+	}
+	sent := 0
+	for _, dev := range devices {
+		t := faxTarget{Device: dev.ID, Name: dev.Name}
+		if err := h.publishFax(dev, payload); err != nil {
+			log.Printf("[ERROR] cannot send fax %s to %s: %v", env.ID, dev.ID, err)
+			t.Status, t.Reason = common.FaxFailed, "cannot transmit the fax"
+		} else {
+			sent++
+		}
+		rec.Targets = append(rec.Targets, t)
+	}
+	if sent == 0 {
+		return errors.New("cannot transmit the fax to any device")
+	}
+
+	if err := h.composer.Close(d, "Fax sent", statusBlocks(d, rec)); err != nil {
+		log.Printf("[ERROR] cannot update Slack message for fax %s: %v", env.ID, err)
+	}
+
+	// Remember the message, so that it can be updated with delivery receipts
+	if err := h.tracker.Track(env.ID, rec); err != nil {
+		log.Printf("[ERROR] cannot track fax %s: %v", env.ID, err)
+	}
+	return nil
+}
+
+// faxID derives the message ID of a fax from the Slack message being
+// confirmed: if the same action is delivered twice (Slack retries when we're
+// slow to answer), the devices see the same ID and print the fax only once.
+func faxID(channel, ts string) string {
+	h := sha256.Sum256([]byte(channel + "/" + ts))
+	return hex.EncodeToString(h[:16])
+}
+
+// publishFax seals the envelope for the specified device and sends it.
+func (h interactionHandler) publishFax(d *Device, envelope []byte) error {
+	payload, err := common.SealFax(envelope, d.Key(), faxKeys)
+	if err != nil {
+		return err
+	}
+
+	token := h.mqttClient.Publish(d.Topic(), 2, false, payload)
+	if !token.WaitTimeout(5 * time.Second) {
+		return errTimeout
+	}
+	return token.Error()
+}
@@ -3,42 +3,213 @@ package main
 import (
 	"bytes"
 	"image"
+	"image/color"
+	_ "image/jpeg"
 	"image/png"
+	"math"
 	"os"
 	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/rasky/CryptoFaxPA/common"
 	"github.com/vmihailenco/msgpack"
 
 	"github.com/go-redis/cache"
 
-	dither "github.com/esimov/dithergo"
 	resize "github.com/nfnt/resize"
 )
 
-var stucki = dither.Dither{
-	"Stucki",
-	dither.Settings{
-		[][]float32{
-			[]float32{0.0, 0.0, 0.0, 8.0 / 42.0, 4.0 / 42.0},
-			[]float32{2.0 / 42.0, 4.0 / 42.0, 8.0 / 42.0, 4.0 / 42.0, 2.0 / 42.0},
-			[]float32{1.0 / 42.0, 2.0 / 42.0, 4.0 / 42.0, 2.0 / 42.0, 1.0 / 42.0},
-		},
-	},
+// Image presets that the sender can pick for the picture of a fax.
+const (
+	imageAuto       = "auto"
+	imagePhoto      = "photo"
+	imageScreenshot = "screenshot"
+	imageDrawing    = "drawing"
+	imageHalftone   = "halftone"
+)
+
+// ImageOptions describe how an image is converted to black & white.
+type ImageOptions struct {
+	Dither       common.DitherMethod
+	AutoContrast bool    // stretch levels to the full black-white range
+	Gamma        float64 // >1 brightens the image, 0 means no correction
+	Sharpen      bool
+}
+
+// imagePresetOptions returns the options for a preset picked by the sender;
+// imageAuto (or an unknown preset) chooses them from the image statistics.
+func imagePresetOptions(preset string, gray *image.Gray) ImageOptions {
+	switch preset {
+	case imagePhoto:
+		return ImageOptions{Dither: common.DitherStucki, AutoContrast: true, Sharpen: true}
+	case imageScreenshot:
+		return ImageOptions{Dither: common.DitherAtkinson}
+	case imageDrawing:
+		return ImageOptions{Dither: common.DitherThreshold, AutoContrast: true}
+	case imageHalftone:
+		return ImageOptions{Dither: common.DitherBayer, AutoContrast: true}
+	}
+	return AutoImageOptions(gray)
+}
+
+// AutoImageOptions chooses the conversion options that best suit an image:
+//   - line art (almost only black and white) is thresholded;
+//   - screenshots (few distinct gray levels, large flat areas) use Atkinson,
+//     which keeps text crisp;
+//   - everything else is treated as a photo.
+func AutoImageOptions(gray *image.Gray) ImageOptions {
+	var hist [256]int
+	for _, px := range gray.Pix {
+		hist[px]++
+	}
+	total := len(gray.Pix)
+	if total == 0 {
+		return ImageOptions{Dither: common.DitherFloydSteinberg}
+	}
+
+	extremes, levels, sum := 0, 0, 0
+	for v, n := range hist {
+		if v < 32 || v >= 224 {
+			extremes += n
+		}
+		if n > total/1000 {
+			levels++
+		}
+		sum += v * n
+	}
+
+	switch {
+	case extremes > total*9/10:
+		return ImageOptions{Dither: common.DitherThreshold, AutoContrast: true}
+	case levels < 64:
+		return ImageOptions{Dither: common.DitherAtkinson}
+	}
+
+	// Brighten (or darken) photos so that the average is mid-gray, as
+	// dark photos are just black blobs once printed
+	opts := ImageOptions{Dither: common.DitherStucki, AutoContrast: true, Sharpen: true}
+	if mean := float64(sum) / float64(total) / 255; mean > 0 && mean < 1 {
+		opts.Gamma = math.Max(0.5, math.Min(2, math.Log(mean)/math.Log(0.5)))
+	}
+	return opts
+}
+
+// Apply preprocesses the image according to the options, and dithers it.
+func (opts ImageOptions) Apply(gray *image.Gray) *image.Paletted {
+	if opts.AutoContrast {
+		autoContrast(gray)
+	}
+	if opts.Gamma > 0 && opts.Gamma != 1 {
+		var lut [256]uint8
+		for i := range lut {
+			lut[i] = uint8(255*math.Pow(float64(i)/255, 1/opts.Gamma) + 0.5)
+		}
+		for i, px := range gray.Pix {
+			gray.Pix[i] = lut[px]
+		}
+	}
+	if opts.Sharpen {
+		gray = sharpen(gray)
+	}
+	return opts.Dither.Dither(gray)
+}
+
+// autoContrast stretches the levels of the image, so that the darkest 1% of
+// the pixels becomes black and the lightest 1% becomes white.
+func autoContrast(gray *image.Gray) {
+	var hist [256]int
+	for _, px := range gray.Pix {
+		hist[px]++
+	}
+	clip := len(gray.Pix) / 100
+
+	lo, hi := 0, 255
+	for n := 0; lo < 255 && n+hist[lo] <= clip; lo++ {
+		n += hist[lo]
+	}
+	for n := 0; hi > 0 && n+hist[hi] <= clip; hi-- {
+		n += hist[hi]
+	}
+	if hi <= lo {
+		return // flat image
+	}
+
+	for i, px := range gray.Pix {
+		v := (int(px) - lo) * 255 / (hi - lo)
+		if v < 0 {
+			v = 0
+		} else if v > 255 {
+			v = 255
+		}
+		gray.Pix[i] = uint8(v)
+	}
+}
+
+// sharpen applies a 3x3 sharpening filter, which helps dithered photos keep
+// some detail.
+func sharpen(gray *image.Gray) *image.Gray {
+	b := gray.Bounds()
+	out := image.NewGray(b)
+	at := func(x, y int) int {
+		// Clamp to the edges
+		if x < b.Min.X {
+			x = b.Min.X
+		} else if x >= b.Max.X {
+			x = b.Max.X - 1
+		}
+		if y < b.Min.Y {
+			y = b.Min.Y
+		} else if y >= b.Max.Y {
+			y = b.Max.Y - 1
+		}
+		return int(gray.GrayAt(x, y).Y)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			v := 5*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1)
+			if v < 0 {
+				v = 0
+			} else if v > 255 {
+				v = 255
+			}
+			out.SetGray(x, y, color.Gray{uint8(v)})
+		}
+	}
+	return out
 }
 
-// Load an image (PNG or JPG), resize, convert to monochrome and return as PNG
-func ConvertImageMono(in []byte, width uint) ([]byte, error) {
+// ResizeImageGray decodes an image (PNG or JPG), resizes it and converts it to
+// grayscale, returning it as PNG. This is the source for ConvertImageMono.
+func ResizeImageGray(in []byte, width uint) ([]byte, error) {
 	orig, _, err := image.Decode(bytes.NewReader(in))
 	if err != nil {
 		return nil, err
 	}
 
 	img := resize.Resize(width, 0, orig, resize.Lanczos3)
-	imgmono := stucki.Monochrome(img, 1.0)
 
 	var out bytes.Buffer
-	png.Encode(&out, imgmono)
+	if err := png.Encode(&out, common.ToGray(img)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Convert an image prepared with ResizeImageGray to monochrome with the
+// specified preset, and return it as PNG
+func ConvertImageMono(in []byte, preset string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+
+	gray := common.ToGray(img)
+	imgmono := imagePresetOptions(preset, gray).Apply(gray)
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, imgmono); err != nil {
+		return nil, err
+	}
 	return out.Bytes(), nil
 }
 
@@ -55,6 +226,7 @@ func SaveImagePNG(img image.Image, path string) error {
 
 type ImageCache struct {
 	cache *cache.Codec
+	redis *redis.Client
 }
 
 func NewImageCache(redisUrl string) (*ImageCache, error) {
@@ -79,7 +251,7 @@ func NewImageCache(redisUrl string) (*ImageCache, error) {
 		},
 	}
 
-	return &ImageCache{cache: cache}, nil
+	return &ImageCache{cache: cache, redis: inst}, nil
 }
 
 func (ic *ImageCache) Set(key string, object interface{}, expiration time.Duration) error {
@@ -97,3 +269,30 @@ func (ic *ImageCache) Get(key string, object interface{}) error {
 func (ic *ImageCache) Del(key string) error {
 	return ic.cache.Delete(key)
 }
+
+// SetNX sets a flag in key, unless it's already set, in a single atomic
+// operation; it returns true if the flag was set.
+func (ic *ImageCache) SetNX(key string, expiration time.Duration) (bool, error) {
+	return ic.redis.SetNX(key, 1, expiration).Result()
+}
+
+// TryLock takes the lock in key, unless somebody else holds it; token
+// identifies the holder, for Unlock. The lock is released by itself after
+// expiration.
+func (ic *ImageCache) TryLock(key, token string, expiration time.Duration) (bool, error) {
+	return ic.redis.SetNX(key, token, expiration).Result()
+}
+
+// unlockScript deletes a lock only if it's still held by the token.
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// Unlock releases a lock taken with TryLock, unless it expired and was
+// taken by somebody else in the meantime.
+func (ic *ImageCache) Unlock(key, token string) error {
+	return unlockScript.Run(ic.redis, []string{key}, token).Err()
+}
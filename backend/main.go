@@ -9,6 +9,7 @@ import (
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/nlopes/slack"
+	"github.com/rasky/CryptoFaxPA/common"
 )
 
 // https://api.slack.com/slack-apps
@@ -23,8 +24,9 @@ type envConfig struct {
 	// BotToken is bot user token to access to slack API.
 	BotToken string `envconfig:"BOT_TOKEN" required:"true"`
 
-	// VerificationToken is used to validate interactive messages from slack.
-	VerificationToken string `envconfig:"VERIFICATION_TOKEN" required:"true"`
+	// SigningSecret is used to verify the signature of the requests sent by
+	// slack (interactive messages and events).
+	SigningSecret string `envconfig:"SLACK_SIGNING_SECRET" required:"true"`
 
 	// BotID is bot user ID.
 	BotID string `envconfig:"BOT_ID" required:"true"`
@@ -32,15 +34,42 @@ type envConfig struct {
 	// CloudMQTT URL to connect to
 	MqttUrl string `envconfig:"CLOUDMQTT_URL" required:"true"`
 
+	// TLS configuration of the MQTT connection (see common.MqttConfig): CA
+	// bundle, comma-separated certificate pins and client certificate
+	MqttCAFile   string   `envconfig:"MQTT_CA_FILE"`
+	MqttPins     []string `envconfig:"MQTT_PINS"`
+	MqttCertFile string   `envconfig:"MQTT_CERT_FILE"`
+	MqttKeyFile  string   `envconfig:"MQTT_KEY_FILE"`
+
 	// Redis URL to connect to
 	RedisUrl string `envconfig:"REDIS_URL" required:"true"`
 
+	// Private key used to seal faxes (base64, see faxkey)
+	FaxPrivateKey string `envconfig:"FAX_PRIVATE_KEY" required:"true"`
+
+	// Registry of the devices faxes can be sent to, as a JSON list of
+	// {"id", "name", "owner", "public_key", "groups"} objects
+	Devices string `envconfig:"DEVICES"`
+
+	// Public key of the single device used when DEVICES is not configured
+	DevicePublicKey string `envconfig:"DEVICE_PUBLIC_KEY"`
+
+	// Fallback fonts used to render text faxes, for characters missing in
+	// the default font (eg: CJK, emoji); a comma-separated list of TTF files
+	FontFallbacks []string `envconfig:"FONT_FALLBACKS"`
+
+	// Also receive messages through the legacy RTM API, for classic Slack
+	// apps without Events API subscriptions (message.im and app_mention)
+	SlackRTM bool `envconfig:"SLACK_RTM"`
+
 	// Turn off low-level Slack API debugging
 	Debug bool `envconfig:"DEBUG"`
 }
 
 var env envConfig
 
+var faxKeys *common.KeyPair
+
 func main() {
 	os.Exit(_main(os.Args[1:]))
 }
@@ -51,35 +80,111 @@ func _main(args []string) int {
 		return 1
 	}
 
+	priv, err := common.ParseKey(env.FaxPrivateKey)
+	if err != nil {
+		log.Printf("[ERROR] FAX_PRIVATE_KEY: %s", err)
+		return 1
+	}
+	faxKeys = common.KeyPairFromPrivate(priv)
+
+	var devices *DeviceRegistry
+	if env.Devices != "" {
+		devices, err = NewDeviceRegistry(env.Devices)
+	} else {
+		devices, err = newDeviceRegistry([]*Device{
+			{ID: common.DefaultDeviceId, Name: "CryptoFaxPA", PublicKey: env.DevicePublicKey},
+		})
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to load device registry: %s", err)
+		return 1
+	}
+
+	renderers := make(map[string]*TextRenderer)
+	for size, dots := range FontSizes {
+		if renderers[size], err = NewTextRenderer(dots, env.FontFallbacks); err != nil {
+			log.Printf("[ERROR] Failed to load fonts: %s", err)
+			return 1
+		}
+	}
+
 	imgcache, err := NewImageCache(env.RedisUrl)
 	if err != nil {
 		log.Printf("[ERROR] Failed to connect to Redis: %s", err)
 		return 1
 	}
 
+	// Keep a single connection to CloudMQTT, used both to publish faxes and
+	// to receive delivery receipts from devices
+	mqttClient, err := common.NewMqttClient("backend", &common.MqttConfig{
+		URL:      env.MqttUrl,
+		CAFile:   env.MqttCAFile,
+		Pins:     env.MqttPins,
+		CertFile: env.MqttCertFile,
+		KeyFile:  env.MqttKeyFile,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to connect to CloudMQTT: %s", err)
+		return 1
+	}
+	defer mqttClient.Disconnect(0)
+
 	// Listening slack event and response
 	log.Printf("[INFO] Start slack event listening")
 	client := slack.New(env.BotToken)
 	client.SetDebug(env.Debug)
-	slackListener := &SlackListener{
-		token:     env.BotToken,
-		verftoken: env.VerificationToken,
-		client:    client,
-		botID:     env.BotID,
-		imgcache:  imgcache,
+	api := newSlackAPI(env.BotToken)
+
+	tracker := &FaxTracker{
+		slackClient: client,
+		api:         api,
+		cache:       imgcache,
+	}
+	if err := tracker.Subscribe(mqttClient); err != nil {
+		log.Printf("[ERROR] Failed to subscribe to fax status: %s", err)
+		return 1
 	}
-	go slackListener.ListenAndResponse()
 
-	// Register handler to receive interactive message
-	// responses from slack (kicked by user action)
-	http.Handle("/interaction", interactionHandler{
-		verificationToken: env.VerificationToken,
-		imgcache:          imgcache,
-	})
+	presence := NewPresenceTracker()
+	if err := presence.Subscribe(mqttClient); err != nil {
+		log.Printf("[ERROR] Failed to subscribe to device presence: %s", err)
+		return 1
+	}
+
+	composer := &FaxComposer{
+		api:       api,
+		cache:     imgcache,
+		devices:   devices,
+		presence:  presence,
+		renderers: renderers,
+	}
+
+	slackListener := &SlackListener{
+		token:    env.BotToken,
+		client:   client,
+		botID:    env.BotID,
+		imgcache: imgcache,
+		composer: composer,
+		events:   imgcache,
+	}
+	if env.SlackRTM {
+		go slackListener.ListenAndResponse()
+	}
 
-	// Register handle to use Events API; for now this is a simple workaround
-	// to restart the dyno if Heroku sends it to sleep
-	http.HandleFunc("/events", slackListener.HandleEventsAPI)
+	// Register handler to receive the interactions with the confirmation
+	// messages and the modals from slack (kicked by user action)
+	http.Handle("/interaction", verifySlackRequests(env.SigningSecret, interactionHandler{
+		api:        api,
+		composer:   composer,
+		mqttClient: mqttClient,
+		tracker:    tracker,
+		devices:    devices,
+	}))
+
+	// Register handler to receive messages through the Events API (which
+	// also wakes up the dyno if Heroku sends it to sleep)
+	http.Handle("/events", verifySlackRequests(env.SigningSecret,
+		http.HandlerFunc(slackListener.HandleEventsAPI)))
 
 	http.HandleFunc("/image/", func(rw http.ResponseWriter, req *http.Request) {
 		var img []byte
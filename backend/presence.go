@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rasky/CryptoFaxPA/common"
+	"github.com/vmihailenco/msgpack"
+)
+
+// PresenceTracker follows the presence published by the devices, to know
+// which ones are online.
+type PresenceTracker struct {
+	m        sync.Mutex
+	presence map[string]*common.DevicePresence
+	seen     map[string]time.Time // when the presence was last published
+}
+
+func NewPresenceTracker() *PresenceTracker {
+	return &PresenceTracker{
+		presence: make(map[string]*common.DevicePresence),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// Subscribe starts listening for the presence of all devices. Presence
+// messages are retained, so the current state is received right away.
+func (t *PresenceTracker) Subscribe(c mqtt.Client) error {
+	token := c.Subscribe(common.PresenceTopicFilter, 1, t.handlePresence)
+	if !token.WaitTimeout(5 * time.Second) {
+		return errTimeout
+	}
+	return token.Error()
+}
+
+func (t *PresenceTracker) handlePresence(c mqtt.Client, msg mqtt.Message) {
+	var p common.DevicePresence
+	if err := msgpack.Unmarshal(msg.Payload(), &p); err != nil {
+		log.Printf("[ERROR] invalid presence on %s: %v", msg.Topic(), err)
+		return
+	}
+	// Devices can only publish on their own topics: don't let one of them
+	// speak for another
+	if id := common.PresenceDevice(msg.Topic()); id == "" || id != p.Device {
+		log.Printf("[ERROR] presence of device %q published on %s", p.Device, msg.Topic())
+		return
+	}
+	if p.Online {
+		log.Printf("[INFO] device %s online: version %q, up %v, %d faxes in spool, %s %s",
+			p.Device, p.Version, p.Uptime, p.Spool, p.Network, p.Signal)
+	} else {
+		log.Printf("[INFO] device %s offline", p.Device)
+	}
+
+	// A retained message was published some time ago: trust the device
+	// clock to know when
+	seen := time.Now()
+	if msg.Retained() {
+		seen = p.Timestamp
+	}
+
+	t.m.Lock()
+	t.presence[p.Device] = &p
+	t.seen[p.Device] = seen
+	t.m.Unlock()
+}
+
+// Offline returns true if the device is known to be offline: either it
+// disconnected, or it stopped publishing its presence. Devices that never
+// published it (eg: older firmwares) are not considered offline.
+func (t *PresenceTracker) Offline(id string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	p, found := t.presence[id]
+	if !found {
+		return false
+	}
+	return !p.Online || time.Since(t.seen[id]) > 3*common.PresenceInterval
+}
+
+// confirmPretext is the question asked to confirm a fax for devices, with a
+// warning if some of them are offline.
+func confirmPretext(devices []*Device, presence *PresenceTracker) string {
+	pretext := "Confirm sending this text to Cryptofax? :fax:"
+	var offline []string
+	for _, d := range devices {
+		if presence.Offline(d.ID) {
+			offline = append(offline, d.Name)
+		}
+	}
+	switch len(offline) {
+	case 0:
+		return pretext
+	case 1:
+		return pretext + fmt.Sprintf("\n:warning: %s is offline, the fax will be queued", offline[0])
+	default:
+		return pretext + fmt.Sprintf("\n:warning: %s are offline, the fax will be queued", strings.Join(offline, ", "))
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rasky/CryptoFaxPA/common"
+	"github.com/vmihailenco/msgpack"
+)
+
+// presenceMessage is a presence received from the MQTT server.
+type presenceMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *presenceMessage) Duplicate() bool   { return false }
+func (m *presenceMessage) Qos() byte         { return 1 }
+func (m *presenceMessage) Retained() bool    { return m.retained }
+func (m *presenceMessage) Topic() string     { return m.topic }
+func (m *presenceMessage) MessageID() uint16 { return 0 }
+func (m *presenceMessage) Payload() []byte   { return m.payload }
+func (m *presenceMessage) Ack()              {}
+
+func receivePresence(t *testing.T, tr *PresenceTracker, topic string, p *common.DevicePresence, retained bool) {
+	payload, err := msgpack.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.handlePresence(nil, &presenceMessage{topic: topic, payload: payload, retained: retained})
+}
+
+func TestPresenceTracker(t *testing.T) {
+	tr := NewPresenceTracker()
+	now := time.Now()
+
+	receivePresence(t, tr, common.PresenceTopic("online"),
+		&common.DevicePresence{Device: "online", Online: true, Timestamp: now}, false)
+	receivePresence(t, tr, common.PresenceTopic("offline"),
+		&common.DevicePresence{Device: "offline", Online: false, Timestamp: now}, true)
+	receivePresence(t, tr, common.PresenceTopic("silent"),
+		&common.DevicePresence{Device: "silent", Online: true, Timestamp: now.Add(-time.Hour)}, true)
+	receivePresence(t, tr, common.PresenceTopic("recent"),
+		&common.DevicePresence{Device: "recent", Online: true, Timestamp: now.Add(-time.Minute)}, true)
+
+	// A device can't publish the presence of another one
+	receivePresence(t, tr, common.PresenceTopic("rogue"),
+		&common.DevicePresence{Device: "victim", Online: false, Timestamp: now}, false)
+	receivePresence(t, tr, common.PresenceTopic("victim"),
+		&common.DevicePresence{Device: "victim", Online: true, Timestamp: now}, false)
+	receivePresence(t, tr, common.PresenceTopic("rogue"),
+		&common.DevicePresence{Device: "victim", Online: false, Timestamp: now}, false)
+	tr.handlePresence(nil, &presenceMessage{topic: common.PresenceTopic("broken"), payload: []byte("garbage")})
+
+	var tests = []struct {
+		id      string
+		offline bool
+	}{
+		{"online", false},
+		{"offline", true},
+		{"silent", true}, // stopped publishing its presence
+		{"recent", false},
+		{"victim", false},
+		{"rogue", false}, // never published its own presence
+		{"broken", false},
+		{"unknown", false},
+	}
+
+	for _, tc := range tests {
+		if offline := tr.Offline(tc.id); offline != tc.offline {
+			t.Errorf("%s: offline=%v, exp %v", tc.id, offline, tc.offline)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"unicode"
+
+	"github.com/rasky/CryptoFaxPA/common"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+)
+
+// TextRenderer lays out text into a monochrome bitmap as wide as the printer,
+// using TrueType fonts. This allows to print any Unicode character, while the
+// printer itself only knows CodePage437.
+//
+// Each character is drawn with the first font that contains it: the main
+// font (Go Regular) first, then the fallback fonts in order (eg: a CJK font
+// and a monochrome emoji font).
+type TextRenderer struct {
+	fonts  []*truetype.Font
+	faces  []font.Face
+	margin int
+}
+
+// NewTextRenderer creates a renderer for the specified font size (in
+// printer dots), loading the fallback fonts from the specified paths.
+func NewTextRenderer(size float64, fallbacks []string) (*TextRenderer, error) {
+	ttfs := [][]byte{goregular.TTF}
+	for _, fn := range fallbacks {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		ttfs = append(ttfs, data)
+	}
+
+	tr := &TextRenderer{margin: 4}
+	for i, data := range ttfs {
+		f, err := truetype.Parse(data)
+		if err != nil {
+			if i == 0 {
+				panic(err) // embedded font
+			}
+			return nil, fmt.Errorf("%s: %v", fallbacks[i-1], err)
+		}
+		tr.fonts = append(tr.fonts, f)
+		tr.faces = append(tr.faces, truetype.NewFace(f, &truetype.Options{
+			Size:    size,
+			DPI:     72, // size is in dots
+			Hinting: font.HintingFull,
+		}))
+	}
+	return tr, nil
+}
+
+// face returns the face to be used to draw the specified rune.
+func (tr *TextRenderer) face(r rune) font.Face {
+	for i, f := range tr.fonts {
+		if f.Index(r) != 0 {
+			return tr.faces[i]
+		}
+	}
+	return tr.faces[0] // will draw the "missing glyph" box
+}
+
+func (tr *TextRenderer) advance(s string) (adv fixed.Int26_6) {
+	for _, r := range s {
+		a, _ := tr.face(r).GlyphAdvance(r)
+		adv += a
+	}
+	return
+}
+
+// wrap splits text into lines that fit into width, breaking on spaces and
+// splitting words that are too long to fit on a line by themselves.
+func (tr *TextRenderer) wrap(text string, width fixed.Int26_6) []string {
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		var line string
+		for _, word := range strings.FieldsFunc(para, unicode.IsSpace) {
+			cand := word
+			if line != "" {
+				cand = line + " " + word
+			}
+			if tr.advance(cand) <= width {
+				line = cand
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			// Split words which don't fit on a line by themselves
+			for tr.advance(word) > width {
+				var i, n int
+				for i = range word {
+					if i > 0 && tr.advance(word[:i]) > width {
+						break
+					}
+					n = i
+				}
+				if n == 0 {
+					break // a single glyph wider than the paper, nothing to do
+				}
+				lines = append(lines, word[:n])
+				word = word[n:]
+			}
+			line = word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Render lays out the text and returns it as a monochrome PNG image.
+func (tr *TextRenderer) Render(text string) ([]byte, error) {
+	width := common.PrinterDots - 2*tr.margin
+	lines := tr.wrap(text, fixed.I(width))
+
+	var ascent, height fixed.Int26_6
+	for _, f := range tr.faces {
+		m := f.Metrics()
+		if m.Ascent > ascent {
+			ascent = m.Ascent
+		}
+		if m.Height > height {
+			height = m.Height
+		}
+	}
+
+	img := image.NewGray(image.Rect(0, 0, common.PrinterDots, height.Ceil()*len(lines)))
+	draw.Draw(img, img.Bounds(), image.White, image.ZP, draw.Src)
+
+	d := font.Drawer{Dst: img, Src: image.Black}
+	for i, line := range lines {
+		d.Dot = fixed.Point26_6{X: fixed.I(tr.margin), Y: ascent + height*fixed.Int26_6(i)}
+		for _, r := range line {
+			d.Face = tr.face(r)
+			d.DrawString(string(r))
+		}
+	}
+
+	// Antialiased edges would be printed as noise, so threshold the image
+	mono := image.NewPaletted(img.Bounds(), color.Palette{color.White, color.Black})
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			if img.GrayAt(x, y).Y < 128 {
+				mono.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, mono); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rasky/CryptoFaxPA/common"
+	"golang.org/x/image/math/fixed"
+)
+
+// squareFont builds a minimal TrueType font, whose only glyph is a filled
+// square (0.8em wide) mapped to the specified runes. It stands for
+// the CJK and emoji fonts, which can't be shipped with the tests.
+func squareFont(runes ...rune) []byte {
+	be := binary.BigEndian
+	table := func(size int) []byte { return make([]byte, size) }
+
+	head := table(54)
+	be.PutUint32(head[0:], 0x00010000)
+	be.PutUint32(head[12:], 0x5F0F3CF5)
+	be.PutUint16(head[18:], 1000) // units per em
+	be.PutUint16(head[40:], 1000)
+	be.PutUint16(head[42:], 1000)
+	be.PutUint16(head[50:], 1) // long loca offsets
+
+	maxp := table(32)
+	be.PutUint32(maxp[0:], 0x00010000)
+	be.PutUint16(maxp[4:], 2) // glyphs: .notdef and the square
+
+	hhea := table(36)
+	be.PutUint32(hhea[0:], 0x00010000)
+	be.PutUint16(hhea[4:], 800)
+	be.PutUint16(hhea[6:], uint16(0x10000-200))
+	be.PutUint16(hhea[34:], 2)
+
+	hmtx := table(8)
+	be.PutUint16(hmtx[0:], 1000)
+	be.PutUint16(hmtx[4:], 1000)
+
+	// One contour through (100,0) (900,0) (900,800) (100,800)
+	glyph := table(10)
+	be.PutUint16(glyph[0:], 1)
+	be.PutUint16(glyph[2:], 100)
+	be.PutUint16(glyph[6:], 900)
+	be.PutUint16(glyph[8:], 800)
+	var buf bytes.Buffer
+	buf.Write(glyph)
+	for _, v := range []int16{3, 0} { // end point, no instructions
+		binary.Write(&buf, be, v)
+	}
+	buf.Write([]byte{1, 1, 1, 1}) // on curve, 16-bit coordinates
+	for _, v := range []int16{100, 800, 0, -800, 0, 0, 800, 0} {
+		binary.Write(&buf, be, v)
+	}
+	glyf := buf.Bytes()
+
+	loca := table(12)
+	be.PutUint32(loca[8:], uint32(len(glyf)))
+
+	// cmap format 12 (Microsoft UCS-4), mapping every rune to the square
+	cmap := table(12 + 16 + 12*len(runes))
+	be.PutUint16(cmap[2:], 1)
+	be.PutUint16(cmap[4:], 3)
+	be.PutUint16(cmap[6:], 10)
+	be.PutUint32(cmap[8:], 12)
+	be.PutUint16(cmap[12:], 12)
+	be.PutUint32(cmap[16:], uint32(16+12*len(runes)))
+	be.PutUint32(cmap[24:], uint32(len(runes)))
+	for i, r := range runes {
+		be.PutUint32(cmap[28+12*i:], uint32(r))
+		be.PutUint32(cmap[32+12*i:], uint32(r))
+		be.PutUint32(cmap[36+12*i:], 1)
+	}
+
+	tables := []struct {
+		tag  string
+		data []byte
+	}{
+		{"cmap", cmap}, {"glyf", glyf}, {"head", head}, {"hhea", hhea},
+		{"hmtx", hmtx}, {"loca", loca}, {"maxp", maxp},
+	}
+	var ttf bytes.Buffer
+	binary.Write(&ttf, be, uint32(0x00010000))
+	binary.Write(&ttf, be, uint16(len(tables)))
+	ttf.Write(make([]byte, 6))
+	offset := 12 + 16*len(tables)
+	for _, t := range tables {
+		ttf.WriteString(t.tag)
+		binary.Write(&ttf, be, uint32(0)) // checksum, not verified
+		binary.Write(&ttf, be, uint32(offset))
+		binary.Write(&ttf, be, uint32(len(t.data)))
+		offset += (len(t.data) + 3) &^ 3
+	}
+	for _, t := range tables {
+		ttf.Write(t.data)
+		ttf.Write(make([]byte, (4-len(t.data)%4)%4))
+	}
+	return ttf.Bytes()
+}
+
+// newTestRenderer creates a renderer with the square font as fallback for
+// some CJK ideographs and emoji.
+func newTestRenderer(t *testing.T) *TextRenderer {
+	dir, err := ioutil.TempDir("", "render")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "square.ttf")
+	ttf := squareFont('中', '文', '😀', '🚀')
+	if err := ioutil.WriteFile(fn, ttf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewTextRenderer(24, []string{fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestTextRendererWrap(t *testing.T) {
+	tr, err := NewTextRenderer(24, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width := tr.advance("Ciao team, ")
+
+	var tests = []struct {
+		text  string
+		lines []string
+	}{
+		{"Ciao", []string{"Ciao"}},
+		{"Ciao team, come va?", []string{"Ciao team,", "come va?"}},
+		{"Ciao   team,\tcome", []string{"Ciao team,", "come"}},
+		{"Ciao\n\nteam", []string{"Ciao", "", "team"}},
+		{"", []string{""}},
+	}
+
+	for _, tc := range tests {
+		lines := tr.wrap(tc.text, width)
+		if strings.Join(lines, "|") != strings.Join(tc.lines, "|") {
+			t.Errorf("%q: got %q, exp %q", tc.text, lines, tc.lines)
+		}
+	}
+
+	// Words longer than a line are split, without losing any character
+	for _, word := range []string{
+		"https://example.com/a/very/long/url/that/does/not/fit",
+		"Supercalifragilistichespiralidoso!",
+		"àèìòùàèìòùàèìòùàèìòùàèìòù",
+	} {
+		lines := tr.wrap("Ciao "+word, width)
+		if lines[0] != "Ciao" || strings.Join(lines[1:], "") != word {
+			t.Errorf("%q: invalid split: %q", word, lines)
+		}
+		for _, l := range lines {
+			if tr.advance(l) > width {
+				t.Errorf("%q: line too long: %q", word, l)
+			}
+		}
+	}
+
+	// A glyph wider than the paper is left alone, rather than looping
+	if lines := tr.wrap("WW", fixed.I(1)); strings.Join(lines, "") != "WW" {
+		t.Errorf("narrow paper: got %q", lines)
+	}
+}
+
+func TestTextRendererFallback(t *testing.T) {
+	plain, err := NewTextRenderer(24, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTestRenderer(t)
+
+	var tests = []struct {
+		r        rune
+		fallback bool
+	}{
+		{'a', false},
+		{'è', false},
+		{'€', false},
+		{'中', true},
+		{'文', true},
+		{'😀', true},
+		{'🚀', true},
+	}
+
+	for _, tc := range tests {
+		if got := tr.face(tc.r) != tr.faces[0]; got != tc.fallback {
+			t.Errorf("%q: fallback=%v, exp %v", tc.r, got, tc.fallback)
+		}
+		if plain.face(tc.r) != plain.faces[0] {
+			t.Errorf("%q: fallback used without fallback fonts", tc.r)
+		}
+	}
+
+	// The advance of the square is 1em, ie: 24 dots
+	if adv := tr.advance("中😀"); adv != fixed.I(48) {
+		t.Errorf("invalid advance of the fallback glyphs: %v", adv)
+	}
+}
+
+// decodeMono decodes a rendered PNG, checking that it's made only of black
+// and white dots, and returns the number of black dots.
+func decodeMono(t *testing.T, data []byte) (image.Image, int) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != common.PrinterDots {
+		t.Errorf("invalid width: %d", img.Bounds().Dx())
+	}
+	black := 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			switch color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y {
+			case 0:
+				black++
+			case 255:
+			default:
+				t.Fatalf("gray dot at %d,%d", x, y)
+			}
+		}
+	}
+	return img, black
+}
+
+func TestTextRendererRender(t *testing.T) {
+	plain, err := NewTextRenderer(24, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTestRenderer(t)
+
+	var tests = []struct {
+		text  string
+		lines int
+	}{
+		{"Ciao!", 1},
+		{"Ciao\nteam", 2},
+		{"中文 😀", 1},
+		{strings.Repeat("中", 40), 3}, // 24 dots each, 376 per line
+	}
+
+	for _, tc := range tests {
+		data, err := tr.Render(tc.text)
+		if err != nil {
+			t.Errorf("%q: %v", tc.text, err)
+			continue
+		}
+		img, black := decodeMono(t, data)
+		if black == 0 {
+			t.Errorf("%q: nothing was drawn", tc.text)
+		}
+		one, _ := tr.Render("Ciao!")
+		h, _ := png.DecodeConfig(bytes.NewReader(one))
+		if img.Bounds().Dy() != tc.lines*h.Height {
+			t.Errorf("%q: invalid height %d, exp %d lines of %d", tc.text, img.Bounds().Dy(), tc.lines, h.Height)
+		}
+	}
+
+	// With the fallback font, ideographs are filled squares rather than the
+	// outline of the "missing glyph" box
+	data, _ := tr.Render("中")
+	_, filled := decodeMono(t, data)
+	data, _ = plain.Render("中")
+	_, missing := decodeMono(t, data)
+	if filled < 300 || filled <= 2*missing {
+		t.Errorf("fallback glyph not drawn: %d black dots, %d without fallback", filled, missing)
+	}
+}
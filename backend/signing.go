@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Requests signed longer ago than this are refused, so that recorded
+// requests can't be replayed.
+const signatureMaxAge = 5 * time.Minute
+
+// Maximum size of the body of the requests sent by Slack
+const signedBodyMaxSize = 1 << 20
+
+var (
+	errNoSignature      = errors.New("missing signature headers")
+	errStaleSignature   = errors.New("timestamp outside of the replay window")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// slackSignature computes the signature of a request body, as sent by Slack
+// in X-Slack-Signature.
+// See https://api.slack.com/authentication/verifying-requests-from-slack
+func slackSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSlackSignature verifies that a request was signed by Slack with the
+// signing secret of the app, less than signatureMaxAge before now.
+func checkSlackSignature(secret string, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	signature := header.Get("X-Slack-Signature")
+	if timestamp == "" || signature == "" {
+		return errNoSignature
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %q", timestamp)
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > signatureMaxAge || age < -signatureMaxAge {
+		return errStaleSignature
+	}
+
+	expected := slackSignature(secret, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// slackVerifier is a middleware that only lets through the requests signed
+// by Slack. The body is read to be verified, so it's replaced with a copy
+// for the next handler.
+type slackVerifier struct {
+	secret string
+	next   http.Handler
+	now    func() time.Time // for tests
+}
+
+func verifySlackRequests(secret string, next http.Handler) http.Handler {
+	return slackVerifier{secret: secret, next: next, now: time.Now}
+}
+
+func (v slackVerifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, signedBodyMaxSize))
+	if err != nil {
+		log.Printf("[ERROR] Failed to read request body: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := checkSlackSignature(v.secret, r.Header, body, v.now()); err != nil {
+		log.Printf("[ERROR] Refusing request to %s: %s", r.URL.Path, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	v.next.ServeHTTP(w, r)
+}
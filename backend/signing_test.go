@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Request recorded in the Slack documentation about request signing
+const (
+	recordedSecret    = "8f742231b10e8888abcd99yyyzzz85a5"
+	recordedTimestamp = "1531420618"
+	recordedSignature = "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"
+	recordedBody      = "token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&channel_id=G8PSS9T3V&channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&command=%2Fwebhook-collect&text=&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN&trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c"
+)
+
+var recordedTime = time.Unix(1531420618, 0)
+
+func TestCheckSlackSignature(t *testing.T) {
+	var tests = []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      string
+		now       time.Time
+		err       bool
+	}{
+		{"valid", recordedSecret, recordedTimestamp, recordedSignature, recordedBody, recordedTime, false},
+		{"clock skew", recordedSecret, recordedTimestamp, recordedSignature, recordedBody, recordedTime.Add(4 * time.Minute), false},
+		{"early", recordedSecret, recordedTimestamp, recordedSignature, recordedBody, recordedTime.Add(-4 * time.Minute), false},
+		{"replayed", recordedSecret, recordedTimestamp, recordedSignature, recordedBody, recordedTime.Add(6 * time.Minute), true},
+		{"wrong secret", "8f742231b10e8888abcd99yyyzzz85a6", recordedTimestamp, recordedSignature, recordedBody, recordedTime, true},
+		{"tampered body", recordedSecret, recordedTimestamp, recordedSignature, recordedBody + "&x=1", recordedTime, true},
+		{"tampered timestamp", recordedSecret, "1531420619", recordedSignature, recordedBody, recordedTime, true},
+		{"bad timestamp", recordedSecret, "yesterday", recordedSignature, recordedBody, recordedTime, true},
+		{"no timestamp", recordedSecret, "", recordedSignature, recordedBody, recordedTime, true},
+		{"no signature", recordedSecret, recordedTimestamp, "", recordedBody, recordedTime, true},
+		{"other version", recordedSecret, recordedTimestamp, "v1" + recordedSignature[2:], recordedBody, recordedTime, true},
+	}
+
+	for _, tc := range tests {
+		header := http.Header{}
+		if tc.timestamp != "" {
+			header.Set("X-Slack-Request-Timestamp", tc.timestamp)
+		}
+		if tc.signature != "" {
+			header.Set("X-Slack-Signature", tc.signature)
+		}
+		err := checkSlackSignature(tc.secret, header, []byte(tc.body), tc.now)
+		if tc.err && err == nil {
+			t.Errorf("%s: request was accepted", tc.name)
+		} else if !tc.err && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestVerifySlackRequests(t *testing.T) {
+	var payload string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body must still be readable as a form
+		payload = r.PostFormValue("payload")
+	})
+	v := verifySlackRequests(recordedSecret, next).(slackVerifier)
+	v.now = func() time.Time { return recordedTime }
+
+	send := func(body, signature string) int {
+		r := httptest.NewRequest("POST", "/interaction", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Slack-Request-Timestamp", recordedTimestamp)
+		r.Header.Set("X-Slack-Signature", signature)
+		w := httptest.NewRecorder()
+		v.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// An interactive message callback; the payload contains "&" and "=",
+	// so it must be decoded as a form field, not sliced out of the body
+	json := `{"type":"interactive_message","actions":[{"name":"start","value":"a=b&c"}],"callback_id":"fax"}`
+	body := url.Values{"payload": {json}}.Encode()
+	signature := slackSignature(recordedSecret, recordedTimestamp, []byte(body))
+
+	if code := send(body, signature); code != http.StatusOK {
+		t.Errorf("signed request refused: %d", code)
+	}
+	if payload != json {
+		t.Errorf("invalid payload: %q", payload)
+	}
+
+	payload = ""
+	if code := send(body, recordedSignature); code != http.StatusUnauthorized {
+		t.Errorf("invalid signature: got status %d", code)
+	}
+	if payload != "" {
+		t.Errorf("unsigned request reached the handler")
+	}
+
+	// Events are JSON, and must reach the handler unchanged
+	var events []byte
+	v.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events, _ = ioutil.ReadAll(r.Body)
+	})
+	event := `{"type":"event_callback","event_id":"Ev0PV52K21","event":{"type":"app_mention"}}`
+	if code := send(event, slackSignature(recordedSecret, recordedTimestamp, []byte(event))); code != http.StatusOK {
+		t.Errorf("signed event refused: %d", code)
+	}
+	if string(events) != event {
+		t.Errorf("invalid event body: %q", events)
+	}
+}
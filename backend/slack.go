@@ -1,8 +1,6 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -17,24 +15,40 @@ import (
 )
 
 const (
-	actionConfirm = "confirm"
-	actionStart   = "start"
-	actionCancel  = "cancel"
+	actionStart  = "start"
+	actionCancel = "cancel"
+	actionEdit   = "edit"
+	actionTarget = "target"
+	actionRender = "render"
+	actionSize   = "size"
+	actionImage  = "image"
 )
 
 type SlackListener struct {
 	token     string
-	verftoken string
 	client    *slack.Client
 	imgcache  *ImageCache
+	composer  *FaxComposer
 	botID     string
 	channelID string
 
 	isIMLock sync.Mutex
 	isIM     map[string]bool
+
+	events eventStore
+}
+
+// eventStore remembers the Events API callbacks for a while, to drop the
+// retries of events that were already received. It's implemented by
+// ImageCache, so that it's shared by all dynos.
+type eventStore interface {
+	// SetNX sets key, unless it's already set; it returns true if it was set.
+	SetNX(key string, expiration time.Duration) (bool, error)
 }
 
-// LstenAndResponse listens slack events and response
+const eventExpiration = time.Hour
+
+// LstenAndResponse listens slack events from the legacy RTM API and response
 // particular messages. It replies by slack message button.
 func (s *SlackListener) ListenAndResponse() {
 	rtm := s.client.NewRTM()
@@ -53,6 +67,62 @@ func (s *SlackListener) ListenAndResponse() {
 	}
 }
 
+// eventCallback is an Events API callback. It's parsed by hand, to get the
+// event ID and the files shared with the messages.
+type eventCallback struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id"`
+	Event   struct {
+		Type        string       `json:"type"`
+		SubType     string       `json:"subtype"`
+		User        string       `json:"user"`
+		BotID       string       `json:"bot_id"`
+		Text        string       `json:"text"`
+		Channel     string       `json:"channel"`
+		ChannelType string       `json:"channel_type"`
+		TimeStamp   string       `json:"ts"`
+		Files       []slack.File `json:"files"`
+	} `json:"event"`
+}
+
+// messageEvent converts the direct messages (message.im) and the mentions
+// (app_mention) to the events received from the RTM API; it returns nil for
+// any other event.
+func (cb *eventCallback) messageEvent() *slack.MessageEvent {
+	ev := &cb.Event
+	if ev.Type != "app_mention" && (ev.Type != "message" || ev.ChannelType != "im") {
+		return nil
+	}
+	return &slack.MessageEvent{Msg: slack.Msg{
+		Type:      "message",
+		SubType:   ev.SubType,
+		User:      ev.User,
+		BotID:     ev.BotID,
+		Text:      ev.Text,
+		Channel:   ev.Channel,
+		Timestamp: ev.TimeStamp,
+		Files:     ev.Files,
+	}}
+}
+
+// seenEvent returns true if the event was already received; otherwise, it
+// remembers it. Event IDs are kept in Redis, so that retries are dropped
+// even if they reach another dyno, or the dyno was restarted; the check and
+// the update are atomic, as retries might be received at the same time.
+func (s *SlackListener) seenEvent(id string) bool {
+	set, err := s.events.SetNX("/event/"+id, eventExpiration)
+	if err != nil {
+		// Better a duplicate than a lost message
+		log.Printf("[ERROR] events API: cannot save event %s: %v", id, err)
+		return false
+	}
+	return !set
+}
+
+// HandleEventsAPI receives the callbacks of the Events API; requests must be
+// authenticated by verifySlackRequests. Slack retries the callbacks that are
+// not acknowledged within 3 seconds, so events are handled in background, and
+// retries of events already received are acknowledged and dropped.
 func (s *SlackListener) HandleEventsAPI(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -61,15 +131,14 @@ func (s *SlackListener) HandleEventsAPI(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	eventsAPIEvent, err := slackevents.ParseEvent(json.RawMessage(body),
-		slackevents.OptionVerifyToken(&slackevents.TokenComparator{s.verftoken}))
-	if err != nil {
+	var cb eventCallback
+	if err := json.Unmarshal(body, &cb); err != nil {
 		log.Printf("[ERROR] events API: parsing: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	switch eventsAPIEvent.Type {
+	switch cb.Type {
 	case slackevents.URLVerification:
 		var r *slackevents.ChallengeResponse
 		err := json.Unmarshal([]byte(body), &r)
@@ -82,12 +151,33 @@ func (s *SlackListener) HandleEventsAPI(w http.ResponseWriter, r *http.Request)
 		w.Write([]byte(r.Challenge))
 
 	case slackevents.CallbackEvent:
-		// postParams := slack.PostMessageParameters{}
-		// innerEvent := eventsAPIEvent.InnerEvent
-		// switch ev := innerEvent.Data.(type) {
-		// case *slackevents.AppMentionEvent:
-		// 	// api.PostMessage(ev.Channel, "Yes, hello.", postParams)
-		// }
+		if retry := r.Header.Get("X-Slack-Retry-Num"); retry != "" {
+			log.Printf("[INFO] events API: retry #%s of event %s (%s)",
+				retry, cb.EventID, r.Header.Get("X-Slack-Retry-Reason"))
+		}
+		if s.seenEvent(cb.EventID) {
+			log.Printf("[INFO] events API: dropping duplicate event %s", cb.EventID)
+			return
+		}
+
+		ev := cb.messageEvent()
+		if ev == nil {
+			return
+		}
+		if cb.Event.Type == "message" {
+			// No need to ask Slack whether the channel is an IM
+			s.isIMLock.Lock()
+			if s.isIM == nil {
+				s.isIM = make(map[string]bool)
+			}
+			s.isIM[ev.Channel] = true
+			s.isIMLock.Unlock()
+		}
+		go func() {
+			if err := s.handleMessageEvent(ev); err != nil {
+				log.Printf("[ERROR] Failed to handle message: %s", err)
+			}
+		}()
 	}
 }
 
@@ -111,9 +201,13 @@ func (s *SlackListener) downloadPrivateFile(url string) ([]byte, error) {
 func (s *SlackListener) handleMessageEvent(ev *slack.MessageEvent) error {
 	log.Printf("*** MSG: %#v", ev.Msg)
 
-	// Ignore all kind of special messages that are not real messages, at least
-	// for now.
-	if ev.Msg.SubType != "" {
+	// Ignore all kind of special messages that are not real messages (except
+	// for files shared with a message), at least for now. This includes the
+	// messages of bots, and our own.
+	if ev.Msg.SubType != "" && ev.Msg.SubType != "file_share" {
+		return nil
+	}
+	if ev.Msg.BotID != "" || ev.Msg.User == s.botID {
 		return nil
 	}
 
@@ -160,20 +254,25 @@ func (s *SlackListener) handleMessageEvent(ev *slack.MessageEvent) error {
 				return fmt.Errorf("error retrieving image: %v", err)
 			}
 
-			img, err = ConvertImageMono(img, 360)
+			src, err := ResizeImageGray(img, 360)
+			if err != nil {
+				return fmt.Errorf("error converting image: %v", err)
+			}
+			img, err = ConvertImageMono(src, imageAuto)
 			if err != nil {
 				return fmt.Errorf("error converting image: %v", err)
 			}
 
 			// Create a random GUID for this image
-			var buf [16]byte
-			if _, err := rand.Read(buf[:]); err != nil {
-				return fmt.Errorf("error acquiring random: %v", err)
+			guid, err := newGUID()
+			if err != nil {
+				return err
 			}
-			guid := hex.EncodeToString(buf[:])
 
-			// Resized images are cached for 30 days (arbitrary)
+			// Resized images are cached for 30 days (arbitrary). The grayscale
+			// source is kept as well, in case the sender picks another preset.
 			s.imgcache.Set("/image/"+guid, img, 30*24*time.Hour)
+			s.imgcache.Set("/source/"+guid, src, 30*24*time.Hour)
 
 			// Set this image as "current" for this channel for 15 minutes.
 			// If a message is sent within 15 minutes, it will use this image
@@ -186,46 +285,11 @@ func (s *SlackListener) handleMessageEvent(ev *slack.MessageEvent) error {
 		return nil
 	}
 
-	// Get last image seen on this channel (if not expired)
-	var imgurl string
-	if s.imgcache.Get("/channel/"+ev.Msg.Channel, &imgurl) == nil {
-		imgurl = env.ServerUrl + imgurl
-	}
-
-	// value is passed to message handler when request is approved.
-	attachment := slack.Attachment{
-		Pretext:    "Confirm sending this text to Cryptofax? :fax:",
-		AuthorName: u.Profile.DisplayName,
-		Color:      "#f9a41b",
-		CallbackID: "cryptofax",
-		Text:       m,
-		ImageURL:   imgurl, // use last image seen in this channel, if any
-		Actions: []slack.AttachmentAction{
-			{
-				Name:  actionStart,
-				Text:  "Fax it :fax:",
-				Type:  "button",
-				Value: m,
-				Style: "primary",
-			},
-			{
-				Name:  actionCancel,
-				Text:  "No",
-				Type:  "button",
-				Style: "danger",
-			},
-		},
-	}
-
-	params := slack.PostMessageParameters{
-		Attachments: []slack.Attachment{
-			attachment,
-		},
-	}
-
-	if _, _, err := s.client.PostMessage(ev.Channel, "", params); err != nil {
-		return fmt.Errorf("failed to post message: %s", err)
-	}
-
-	return nil
+	// Use the last image seen on this channel (if not expired)
+	var image string
+	if s.imgcache.Get("/channel/"+ev.Msg.Channel, &image) == nil {
+		image = strings.TrimPrefix(image, "/image/")
+	}
+
+	return s.composer.Start(ev.Channel, u.Profile.DisplayName, m, image)
 }
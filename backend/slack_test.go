@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryEvents is an eventStore in memory, in place of Redis.
+type memoryEvents struct {
+	m    sync.Mutex
+	keys map[string]bool
+}
+
+func (e *memoryEvents) SetNX(key string, expiration time.Duration) (bool, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.keys[key] {
+		return false, nil
+	}
+	e.keys[key] = true
+	return true, nil
+}
+
+func TestMessageEvent(t *testing.T) {
+	// Callbacks recorded from Slack (shortened)
+	var tests = []struct {
+		json    string
+		message bool
+	}{
+		{`{"type":"event_callback","event_id":"Ev1","event":{"type":"message","user":"U2CERLKJA","text":"Ciao!","channel":"D0PNCRP9N","channel_type":"im","ts":"1548426417.840180"}}`, true},
+		{`{"type":"event_callback","event_id":"Ev2","event":{"type":"app_mention","user":"U2CERLKJA","text":"<@U0LAN0Z89> Ciao!","channel":"C0LAN2Q65","ts":"1548426417.840180"}}`, true},
+		{`{"type":"event_callback","event_id":"Ev3","event":{"type":"message","subtype":"file_share","user":"U2CERLKJA","text":"","channel":"D0PNCRP9N","channel_type":"im","ts":"1548426417.840180","files":[{"id":"F0S43PZDF","url_private":"https://files.slack.com/files-pri/T0-F0S43PZDF/ciao.png"}]}}`, true},
+		{`{"type":"event_callback","event_id":"Ev4","event":{"type":"message","user":"U2CERLKJA","text":"Ciao!","channel":"C0LAN2Q65","channel_type":"channel","ts":"1548426417.840180"}}`, false},
+		{`{"type":"event_callback","event_id":"Ev5","event":{"type":"reaction_added","user":"U2CERLKJA","reaction":"fax"}}`, false},
+	}
+
+	for _, tc := range tests {
+		var cb eventCallback
+		if err := json.Unmarshal([]byte(tc.json), &cb); err != nil {
+			t.Errorf("%s: %v", tc.json, err)
+			continue
+		}
+		ev := cb.messageEvent()
+		if (ev != nil) != tc.message {
+			t.Errorf("%s: message=%v, exp %v", cb.EventID, ev != nil, tc.message)
+			continue
+		}
+		if ev == nil {
+			continue
+		}
+		if ev.Type != "message" || ev.User != cb.Event.User || ev.Text != cb.Event.Text ||
+			ev.Channel != cb.Event.Channel || ev.Timestamp != cb.Event.TimeStamp || ev.SubType != cb.Event.SubType {
+			t.Errorf("%s: invalid message: %+v", cb.EventID, ev.Msg)
+		}
+		if len(ev.Files) != len(cb.Event.Files) {
+			t.Errorf("%s: invalid files: %+v", cb.EventID, ev.Files)
+		}
+	}
+}
+
+func TestEventRetry(t *testing.T) {
+	s := &SlackListener{events: &memoryEvents{keys: make(map[string]bool)}}
+
+	post := func(body string, retry bool) int {
+		r := httptest.NewRequest("POST", "/events", strings.NewReader(body))
+		if retry {
+			r.Header.Set("X-Slack-Retry-Num", "1")
+			r.Header.Set("X-Slack-Retry-Reason", "http_timeout")
+		}
+		w := httptest.NewRecorder()
+		s.HandleEventsAPI(w, r)
+		return w.Code
+	}
+
+	if s.seenEvent("Ev0") || !s.seenEvent("Ev0") {
+		t.Errorf("invalid seen event")
+	}
+
+	// The first delivery of the event is handled (and ignored, as it's not
+	// a message); a message with the same ID is a retry, and is dropped
+	// before looking at it
+	if code := post(`{"type":"event_callback","event_id":"Ev1","event":{"type":"reaction_added"}}`, false); code != http.StatusOK {
+		t.Errorf("invalid status: %d", code)
+	}
+	if code := post(`{"type":"event_callback","event_id":"Ev1","event":{"type":"message","channel":"D0PNCRP9N","channel_type":"im"}}`, true); code != http.StatusOK {
+		t.Errorf("invalid status of retry: %d", code)
+	}
+	if s.isIM["D0PNCRP9N"] {
+		t.Errorf("retried event was handled")
+	}
+}
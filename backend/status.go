@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nlopes/slack"
+	"github.com/rasky/CryptoFaxPA/common"
+	"github.com/vmihailenco/msgpack"
+)
+
+// faxRecord is what we remember about a fax sent to devices, so that its
+// Slack message can be updated as delivery receipts come back.
+type faxRecord struct {
+	Channel   string
+	MessageTs string
+	Draft     *faxDraft
+	Targets   []faxTarget
+
+	// Faxes confirmed before Block Kit messages were attachments
+	Attachment slack.Attachment
+}
+
+type faxTarget struct {
+	Device string
+	Name   string
+	Status common.FaxStatusCode
+	Reason string
+}
+
+// Fields returns the Slack attachment fields describing the delivery status
+// (see statusBlocks).
+func (rec *faxRecord) Fields() []slack.AttachmentField {
+	var fields []slack.AttachmentField
+	for _, t := range rec.Targets {
+		title := faxStatusTitle[t.Status]
+		if len(rec.Targets) > 1 {
+			title = t.Name + ": " + title
+		}
+		fields = append(fields, slack.AttachmentField{
+			Title: title,
+			Value: t.Reason,
+			Short: false,
+		})
+	}
+	return fields
+}
+
+// Order in which statuses normally arrive; used to ignore receipts that
+// arrive out of order.
+var faxStatusRank = map[common.FaxStatusCode]int{
+	common.FaxReceived: 1,
+	common.FaxSpooled:  2,
+	common.FaxPrinting: 3,
+	common.FaxDelayed:  3,
+	common.FaxPrinted:  4,
+	common.FaxFailed:   4,
+}
+
+var faxStatusTitle = map[common.FaxStatusCode]string{
+	"":                 ":outbox_tray: your fax has been encrypted and transmitted!",
+	common.FaxReceived: ":satellite_antenna: your fax has been received by CryptoFaxPA",
+	common.FaxSpooled:  ":inbox_tray: your fax is waiting to be printed",
+	common.FaxPrinting: ":fax: your fax is being printed...",
+	common.FaxDelayed:  ":hourglass: your fax is waiting for the printer to be fixed",
+	common.FaxPrinted:  ":white_check_mark: your fax has been printed!",
+	common.FaxFailed:   ":warning: your fax could not be printed",
+}
+
+// FaxTracker follows the delivery receipts sent by the devices and updates
+// the corresponding Slack messages.
+type FaxTracker struct {
+	slackClient *slack.Client
+	api         *slackAPI
+	cache       *ImageCache
+
+	// Receipts for the same fax arrive close together (eg: "received" and
+	// "spooled"), possibly from different devices, and would race on the
+	// cached record, so updates are serialized.
+	m sync.Mutex
+}
+
+// Faxes are tracked for 30 days (arbitrary); a device offline for longer
+// than that won't be able to report back.
+const faxTrackingExpiration = 30 * 24 * time.Hour
+
+// Track starts tracking the fax with the specified ID.
+func (t *FaxTracker) Track(id string, rec *faxRecord) error {
+	return t.cache.Set("/fax/"+id, rec, faxTrackingExpiration)
+}
+
+// Subscribe starts listening for delivery receipts from all devices.
+func (t *FaxTracker) Subscribe(c mqtt.Client) error {
+	token := c.Subscribe(common.FaxStatusTopicFilter, 1, t.handleStatus)
+	if !token.WaitTimeout(5 * time.Second) {
+		return errTimeout
+	}
+	return token.Error()
+}
+
+func (t *FaxTracker) handleStatus(c mqtt.Client, msg mqtt.Message) {
+	var st common.FaxStatus
+	if err := msgpack.Unmarshal(msg.Payload(), &st); err != nil {
+		log.Printf("[ERROR] invalid fax status on %s: %v", msg.Topic(), err)
+		return
+	}
+	log.Printf("[INFO] fax %s on %s: %s %s", st.ID, st.Device, st.Status, st.Reason)
+
+	// Updating Slack might be slow, don't block the MQTT client
+	go t.update(&st)
+}
+
+func (t *FaxTracker) update(st *common.FaxStatus) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var rec faxRecord
+	if err := t.cache.Get("/fax/"+st.ID, &rec); err != nil {
+		log.Printf("[ERROR] status for unknown fax %s: %v", st.ID, err)
+		return
+	}
+
+	var target *faxTarget
+	for i := range rec.Targets {
+		if rec.Targets[i].Device == st.Device {
+			target = &rec.Targets[i]
+		}
+	}
+	if target == nil {
+		log.Printf("[ERROR] status for fax %s from unexpected device %s", st.ID, st.Device)
+		return
+	}
+
+	// A failed fax can be retried, otherwise never go backwards
+	if faxStatusRank[st.Status] < faxStatusRank[target.Status] && target.Status != common.FaxFailed {
+		return
+	}
+	target.Status, target.Reason = st.Status, st.Reason
+	if err := t.Track(st.ID, &rec); err != nil {
+		log.Printf("[ERROR] cannot save status of fax %s: %v", st.ID, err)
+	}
+
+	var err error
+	if rec.Draft != nil {
+		err = t.api.updateMessage(rec.Channel, rec.MessageTs, faxStatusTitle[st.Status], statusBlocks(rec.Draft, &rec))
+	} else {
+		rec.Attachment.Fields = rec.Fields()
+		_, _, _, err = t.slackClient.SendMessage(rec.Channel,
+			slack.MsgOptionUpdate(rec.MessageTs),
+			slack.MsgOptionAttachments(rec.Attachment))
+	}
+	if err != nil {
+		log.Printf("[ERROR] cannot update Slack message for fax %s: %v", st.ID, err)
+	}
+}
@@ -2,43 +2,84 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	humanize "github.com/dustin/go-humanize"
 	"github.com/rasky/CryptoFaxPA/common"
-	"github.com/vmihailenco/msgpack"
 )
 
 const (
-	ClientId      = "client"
 	ClientMqttQos = 2 // Use MQTT QOS=2 to make sure each message is delivered once
 
+	SeenFaxes = 1000 // Number of fax IDs remembered to discard duplicates
+
+	BlockchainTimeout = 10 * time.Second // Max time to wait for the blockchain report
+	BlockchainRefresh = time.Hour        // Refresh period of the offline blockchain report
+
 	PinHelp       = 22
 	PinBlockchain = 23
 )
 
+// DeviceId identifies this device; it's used as MQTT client ID and to build
+// the topics the device subscribes and publishes to.
+var DeviceId = common.DefaultDeviceId
+
 var (
-	flagSpoolDir = flag.String("spool", "/var/spool/cryptofax", "spool directory to use")
+	flagSpoolDir   = flag.String("spool", "/var/spool/cryptofax", "spool directory to use")
+	flagStateDir   = flag.String("state", "/var/lib/cryptofax", "directory for persistent client state")
+	flagKeyFile    = flag.String("key", "/etc/cryptofax/device.key", "private key of this device")
+	flagTrustedKey = flag.String("trusted", "/etc/cryptofax/backend.pub", "public keys of the trusted backends")
+	flagPrinter    = flag.String("printer", "/dev/usb/lp0", "printer device (or file:<path> to print to a file)")
 )
 
 func main() {
 	flag.Parse()
 
-	surl := os.Getenv("CLOUDMQTT_URL")
-	if surl == "" {
+	mqttcfg := &common.MqttConfig{
+		URL:      os.Getenv("CLOUDMQTT_URL"),
+		CAFile:   os.Getenv("MQTT_CA_FILE"),
+		CertFile: os.Getenv("MQTT_CERT_FILE"),
+		KeyFile:  os.Getenv("MQTT_KEY_FILE"),
+	}
+	if mqttcfg.URL == "" {
 		log.Fatal("CLOUDMQTT_URL not defined")
 	}
+	if pins := os.Getenv("MQTT_PINS"); pins != "" {
+		mqttcfg.Pins = strings.Split(pins, ",")
+	}
+	if id := os.Getenv("CRYPTOFAX_DEVICE_ID"); id != "" {
+		DeviceId = id
+	}
+	common.DefaultPrinter = common.OpenPrinter(*flagPrinter)
 
 	if fi, err := os.Stat(*flagSpoolDir); err != nil || !fi.IsDir() {
 		log.Fatalf("%s does not exist or is not a directory", *flagSpoolDir)
 	}
+	spool, err := common.OpenSpool(*flagSpoolDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(*flagStateDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	common.MarketCacheFile = *flagStateDir + "/market.json"
+
+	opener, err := loadFaxOpener()
+	if err != nil {
+		log.Fatal(err)
+	}
+	seen, err := common.OpenSeenIDs(*flagStateDir+"/seen", SeenFaxes)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Check that printer is connected
 	for !common.PrinterIsConnected() {
@@ -54,19 +95,19 @@ func main() {
 	// Start polling timezone in background
 	go common.PollTimezone()
 
-	chfax := make(chan bool, 16)
+	// chfax is signaled whenever the spool must be checked for faxes to print
+	chfax := make(chan bool, 1)
 
 	// See if there are pending faxes in the spool; if so, schedule them right away
-	if files, err := ioutil.ReadDir(*flagSpoolDir); err == nil && len(files) > 0 {
-		log.Printf("[INFO] found %d files in spool at boot", len(files))
-		go func() {
-			for _ = range files {
-				chfax <- true
-			}
-		}()
+	if n, err := spool.Recover(); err != nil {
+		log.Printf("[ERROR] cannot recover spool: %v", err)
+	} else if n > 0 {
+		log.Printf("[INFO] found %d faxes in spool at boot", n)
+		wakeup(chfax)
 	}
 
-	go PollMqtt(chfax, surl)
+	go PollMqtt(chfax, mqttcfg, opener, spool, seen)
+	go refresh_blockchain_snapshot()
 
 	buttonMonitor := NewRPButtonMonitor(PinHelp, PinBlockchain)
 	defer buttonMonitor.Shutdown()
@@ -78,6 +119,7 @@ func main() {
 
 	// Main loop: serialize all printing to avoid printing from different
 	// goroutines at the same time.
+	var retry *time.Timer
 	for {
 		select {
 		case evt := <-buttonMonitor.Events:
@@ -94,77 +136,99 @@ func main() {
 				print_blockchain()
 			}
 		case <-chfax:
-			log.Printf("[DEBUG] printing fax")
-			print_fax_from_spool()
+			print_fax_from_spool(spool)
+
+			// Check again right away if there are other faxes ready, or
+			// when the next one must be retried
+			n, next, err := spool.Pending()
+			if err != nil {
+				log.Printf("[ERROR] cannot access spool: %v", err)
+			} else if n > 0 {
+				if retry != nil {
+					retry.Stop()
+				}
+				retry = time.AfterFunc(time.Until(next), func() { wakeup(chfax) })
+			}
 		}
 	}
 }
 
-func PollMqtt(chfax chan bool, surl string) {
-	var c mqtt.Client
-	sleep := 5 * time.Second
-	for {
-		var err error
-		c, err = common.NewMqttClient(ClientId, surl)
+// wakeup signals ch without blocking: if it's already signaled, the spool
+// will be checked anyway.
+func wakeup(ch chan bool) {
+	select {
+	case ch <- true:
+	default:
+	}
+}
+
+// loadFaxOpener loads the device keys and the trusted backend keys used to
+// decrypt incoming faxes. The device key is generated at first boot; use
+// "faxkey pub" to read the public key to configure in the backend.
+func loadFaxOpener() (*common.FaxOpener, error) {
+	kp, err := common.LoadKeyPair(*flagKeyFile)
+	if os.IsNotExist(err) {
+		if kp, err = common.GenerateKeyPair(); err == nil {
+			err = kp.Save(*flagKeyFile)
+		}
 		if err != nil {
-			common.StartBlinkingRed()
-			log.Printf("[INFO] cannot connect to MQTT server: %v", err)
-			log.Printf("[INFO] retrying in %v...", sleep)
-			// common.PrintString(fmt.Sprintf("MQTT connection failed, retrying in %v...\n\n", sleep), false)
-			time.Sleep(sleep)
-			sleep = sleep + sleep/3
-			if sleep > 5*time.Minute {
-				sleep = 5 * time.Minute
-			}
-		} else {
-			common.StopBlinking()
-			break
+			return nil, fmt.Errorf("cannot generate device key: %v", err)
 		}
+		log.Printf("[INFO] generated device key %s, public key: %v", *flagKeyFile, kp.Public.String())
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot load device key: %v", err)
 	}
-	defer c.Disconnect(0)
+	keys := []*common.KeyPair{kp}
 
-	c.Subscribe(common.FaxMqttTopic, ClientMqttQos, func(client mqtt.Client, msg mqtt.Message) {
-		// Use a filename whose alphabetical sorting respects the order of arrival
-		filename := fmt.Sprintf("%s/%016x", *flagSpoolDir, time.Now().UnixNano())
-		log.Printf("[DEBUG] got MQTT message, written to %s", filename)
-		common.WriteFileSync(filename, msg.Payload(), 0777)
-		chfax <- true
-	})
+	// During a key rotation, keep accepting faxes sealed for the old key
+	if old, err := common.LoadKeyPair(*flagKeyFile + ".old"); err == nil {
+		keys = append(keys, old)
+	}
 
-	log.Printf("[INFO] connected to MQTT server, start polling")
-	// common.PrintString("connected to MQTT server, start polling\n\n", false)
-	select {}
+	trusted, err := common.LoadPublicKeys(*flagTrustedKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load trusted keys: %v", err)
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("no trusted backend keys found in %s", *flagTrustedKey)
+	}
+
+	return common.NewFaxOpener(keys, trusted, *flagStateDir+"/replay")
 }
 
-func print_fax_from_spool() {
-	files, err := ioutil.ReadDir(*flagSpoolDir)
+// print_fax_from_spool prints the oldest fax in the spool that is ready to be
+// printed. Faxes that can't be decoded go straight to the dead letters, while
+// printer errors are retried later.
+func print_fax_from_spool(spool *common.Spool) {
+	e, err := spool.Next()
 	if err != nil {
-		log.Printf("[ERROR] cannot access spool dir: %v", err)
+		log.Printf("[ERROR] cannot read spool: %v", err)
 		return
 	}
-	if len(files) == 0 {
-		log.Printf("[ERROR] internal error: print_fax_from_spool() called with empty spool")
+	if e == nil {
 		return
 	}
 
-	// From this point on, remove the file after we finished processing it.
-	// If the process crashes (eg: system shutdown), the file will still be there
-	fn := *flagSpoolDir + "/" + files[0].Name()
-	defer os.Remove(fn)
-
-	payload, err := ioutil.ReadFile(fn)
+	env, err := common.DecodeEnvelope(e.Data)
 	if err != nil {
-		log.Printf("[ERROR] cannot read spool file: %v", err)
+		log.Printf("[ERROR] error decoding fax envelope: %v", err)
+		if err := e.Fail(err); err != nil {
+			log.Printf("[ERROR] cannot update spool: %v", err)
+		}
 		return
 	}
-
-	var fax common.Fax
-	if err := msgpack.Unmarshal(payload, &fax); err != nil {
-		log.Printf("[ERROR] error decoding mqtt payload: %v", err)
+	fax, err := env.Fax()
+	if err != nil {
+		log.Printf("[ERROR] error decoding fax: %v", err)
+		publishFaxStatus(env.ID, common.FaxFailed, err.Error())
+		if err := e.Fail(err); err != nil {
+			log.Printf("[ERROR] cannot update spool: %v", err)
+		}
 		return
 	}
 
 	fmt.Printf("* New 📠 incoming:\n")
+	fmt.Printf("    - ID: %v (envelope v%d)\n", env.ID, env.Version)
 	fmt.Printf("    - Sender: %v\n", fax.Sender)
 	fmt.Printf("    - Timestamp: %v\n", fax.Timestamp)
 	fmt.Printf("    - Message: %v\n", fax.Message)
@@ -176,8 +240,14 @@ func print_fax_from_spool() {
 		}
 	}
 
+	// Don't bother playing the modem sound if the printer is not ready
+	if st, err := common.DefaultPrinter.Status(); err == nil && st.Err() != nil {
+		retry_fax(e, env, st.Err())
+		return
+	}
+
+	publishFaxStatus(env.ID, common.FaxPrinting, "")
 	common.StartBlinkingGreen()
-	defer common.StopBlinking()
 
 	// Se non è notte fonda, suona la musichetta del modem mentre
 	// inizia a stampare il fax
@@ -191,30 +261,38 @@ func print_fax_from_spool() {
 		log.Printf("[DEBUG] too late, not playing modem sound")
 	}
 
-	print_fax(fax)
+	err = print_fax(fax)
+	common.StopBlinking()
+	if err != nil {
+		retry_fax(e, env, err)
+		return
+	}
+	if err := e.Done(); err != nil {
+		log.Printf("[ERROR] cannot update spool: %v", err)
+	}
+	publishFaxStatus(env.ID, common.FaxPrinted, "")
 }
 
-func print_fax(fax common.Fax) {
-	var buf bytes.Buffer
-	buf.WriteString("\x1b!\x10") // double-height
-	fmt.Fprintf(&buf, "Fax from ")
-	buf.WriteString("\x1b!\x90") // double-height, underlined
-	fmt.Fprintf(&buf, "%v\n", fax.Sender)
-
-	buf.WriteString("\x1b!\x00") // font A, single-height
-	fmt.Fprintf(&buf, "(%v)\n\n", fax.Timestamp.Format("2006-01-02 15:04"))
-
-	if fax.Message != "" {
-		buf.Write(common.EncodeForPrinter(fax.Message))
-		buf.WriteString("\n")
+// retry_fax puts a fax that could not be printed back in the spool, unless
+// it failed too many times already.
+func retry_fax(e *common.SpoolEntry, env *common.Envelope, reason error) {
+	common.StartBlinkingRed()
+	retry, err := e.Retry(reason)
+	switch {
+	case err != nil:
+		log.Printf("[ERROR] cannot update spool: %v", err)
+	case retry:
+		log.Printf("[ERROR] cannot print fax: %v, retrying at %v", reason, e.RetryAt.Format(time.Kitchen))
+		publishFaxStatus(env.ID, common.FaxDelayed, reason.Error())
+	default:
+		log.Printf("[ERROR] cannot print fax after %d attempts: %v", e.Attempts, reason)
+		publishFaxStatus(env.ID, common.FaxFailed, reason.Error())
 	}
+}
 
-	if len(fax.Picture) != 0 {
-		common.PrintBytes(buf.Bytes(), false)
-		common.PrintImage(fax.Picture, true)
-	} else {
-		common.PrintBytes(buf.Bytes(), true)
-	}
+// print_fax prints a fax, returning an error only if the printer failed.
+func print_fax(fax *common.Fax) error {
+	return common.PrintFax(common.DefaultPrinter, fax)
 }
 
 var stopAccessPoint *time.Timer
@@ -223,6 +301,31 @@ func print_help() {
 	common.StartBlinkingGreen()
 	defer common.StopBlinking()
 
+	var network []string
+	for _, iif := range []common.Interface{common.IntfGSM, common.IntfWiFi, common.IntfEthernet} {
+		desc := common.InterfaceInspect(iif)
+		line := fmt.Sprintf("%v <%v>: %v [%v]", desc.Name, string(iif), desc.Status, desc.IP)
+		if desc.Comment != "" {
+			line += fmt.Sprintf(" (%v)", desc.Comment)
+		}
+		network = append(network, line)
+	}
+	network = append(network, "CryptoFax server: "+mqttHealth.String())
+	print_help_page(network)
+
+	// Run the AP for 15 minutes
+	if stopAccessPoint != nil {
+		stopAccessPoint.Stop()
+	}
+	go exec.Command("sudo", "/usr/local/sbin/ap_on.sh").Run()
+	stopAccessPoint = time.AfterFunc(15*time.Minute, func() {
+		exec.Command("sudo", "/usr/local/sbin/ap_off.sh").Run()
+	})
+}
+
+// print_help_page prints the help, followed by the status of the network
+// interfaces (one per line).
+func print_help_page(network []string) {
 	var buf bytes.Buffer
 
 	buf.WriteString("\x1b!\x30") // double-height, double-width
@@ -254,59 +357,112 @@ In particolare CryptoFaxPA consente all'utente (d'ora in avanti denominato per s
 	buf.WriteString("Stato della rete\n")
 	buf.WriteString("\x1b!\x00") // font A, single-height
 
-	for _, iif := range []common.Interface{common.IntfGSM, common.IntfWiFi, common.IntfEthernet} {
-		desc := common.InterfaceInspect(iif)
-		line := fmt.Sprintf("%v <%v>: %v [%v]", desc.Name, string(iif), desc.Status, desc.IP)
-		if desc.Comment != "" {
-			line += fmt.Sprintf(" (%v)", desc.Comment)
-		}
+	for _, line := range network {
 		buf.WriteString(line + "\n")
 	}
 	buf.WriteString("\n\n")
 
 	common.PrintBytes(buf.Bytes(), true)
-
-	// Run the AP for 15 minutes
-	if stopAccessPoint != nil {
-		stopAccessPoint.Stop()
-	}
-	go exec.Command("sudo", "/usr/local/sbin/ap_on.sh").Run()
-	stopAccessPoint = time.AfterFunc(15*time.Minute, func() {
-		exec.Command("sudo", "/usr/local/sbin/ap_off.sh").Run()
-	})
 }
 
 func print_blockchain() {
 	common.StartBlinkingGreen()
 	defer common.StopBlinking()
 
+	// Don't hold the main loop for too long if the providers are slow:
+	// print whatever arrived in time
+	ctx, cancel := context.WithTimeout(context.Background(), BlockchainTimeout)
+	defer cancel()
+
+	snap, err := common.GetBlockchainSnapshot(ctx)
+	if err == nil {
+		save_blockchain_snapshot(snap)
+		print_blockchain_page(common.NowHere(), snap, false)
+		return
+	}
+	log.Printf("[ERROR] cannot get blockchain infos: %v", err)
+
+	// Print the last known data, if any
+	snap, err = common.LoadBlockchainSnapshot(blockchain_snapshot_path())
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] cannot load blockchain snapshot: %v", err)
+	}
+	print_blockchain_page(common.NowHere(), snap, true)
+}
+
+func blockchain_snapshot_path() string {
+	return *flagStateDir + "/blockchain.json"
+}
+
+// save_blockchain_snapshot saves the snapshot printed by print_blockchain
+// when offline, unless some data is missing: a partial report must not
+// replace the last complete one.
+func save_blockchain_snapshot(snap *common.BlockchainSnapshot) {
+	if !snap.Complete() {
+		log.Printf("[INFO] blockchain snapshot is incomplete, not saving it")
+		return
+	}
+	if err := snap.Save(blockchain_snapshot_path()); err != nil {
+		log.Printf("[ERROR] cannot save blockchain snapshot: %v", err)
+	}
+}
+
+// refresh_blockchain_snapshot keeps the snapshot printed by print_blockchain
+// when offline reasonably recent.
+func refresh_blockchain_snapshot() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), BlockchainRefresh/2)
+		snap, err := common.GetBlockchainSnapshot(ctx)
+		cancel()
+		if err == nil {
+			save_blockchain_snapshot(snap)
+		} else {
+			log.Printf("[INFO] cannot refresh blockchain snapshot: %v", err)
+		}
+		time.Sleep(BlockchainRefresh)
+	}
+}
+
+// print_blockchain_page prints the blockchain infos and the graphs of snap.
+// If offline is true, snap is the last known data and is marked as such;
+// if there's no snap at all, it prints that there's no connection.
+func print_blockchain_page(now time.Time, snap *common.BlockchainSnapshot, offline bool) {
 	var buf bytes.Buffer
 
 	buf.WriteString("\x1b!\x30") // double-height, double-width
 	buf.WriteString("BLOCKCHAIN SUPER NERD INFO\n")
 	buf.WriteString("\x1b!\x00") // font A, single-height
-	fmt.Fprintln(&buf, "Updated at:", common.NowHere().Format("2006-01-02 15:04:05 (MST)"))
 
-	infos, err := common.GetBlockchainNerdInfos()
-	if err != nil {
+	if snap == nil {
+		fmt.Fprintln(&buf, "Updated at:", now.Format("2006-01-02 15:04:05 (MST)"))
 		buf.WriteString("\nUh-oh, no Internet connection.\nBlockchain is broken!\n")
 		common.PrintBytes(buf.Bytes(), true)
 		return
 	}
 
-	for _, info := range infos {
-		fmt.Fprintf(&buf, "%s:\n %s\n", info.Name, info.Value)
+	fmt.Fprintln(&buf, "Updated at:", snap.Time.In(now.Location()).Format("2006-01-02 15:04:05 (MST)"))
+	if offline {
+		buf.WriteString("\x1b!\x80") // font A, underlined
+		fmt.Fprintf(&buf, "\nNo Internet connection.\nLast known data (%s):\n\n",
+			humanize.RelTime(snap.Time, now, "ago", "from now"))
+		buf.WriteString("\x1b!\x00") // font A, single-height
+	}
+
+	for _, info := range snap.Infos {
+		// Currency symbols are not ASCII
+		buf.Write(common.EncodeForPrinter(fmt.Sprintf("%s:\n %s\n", info.Name, info.Value)))
 	}
 	common.PrintBytes(buf.Bytes(), true)
 
-	graph := common.GetBitcoinGraph()
-	if graph != nil {
+	for _, g := range snap.Graphs {
 		var buf bytes.Buffer
 		buf.WriteString("\x1b!\x30") // double-height, double-width
-		buf.WriteString("BITCOIN LIVE EXCHANGE\n")
+		buf.WriteString(g.Title + "\n")
 		buf.WriteString("\x1b!\x00") // font A, single-height
 		common.PrintBytes(buf.Bytes(), false)
 
-		common.PrintImage(graph, true)
+		if err := common.PrintImage(g.PNG, true); err != nil {
+			log.Printf("[ERROR] cannot print graph %q: %v", g.Title, err)
+		}
 	}
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rasky/CryptoFaxPA/common"
+)
+
+// connHealth is the state of the connection to the MQTT server. The device
+// is able to receive faxes only when it's both connected and subscribed.
+type connHealth struct {
+	m          sync.Mutex
+	connected  bool
+	subscribed bool
+	since      time.Time // of the last change
+	err        error     // why the connection was lost
+}
+
+// mqttHealth is updated by the MQTT client handlers; it's printed in the
+// help page.
+var mqttHealth connHealth
+
+func (h *connHealth) set(connected, subscribed bool, err error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.connected != connected || h.subscribed != subscribed {
+		h.since = time.Now()
+	}
+	h.connected, h.subscribed, h.err = connected, subscribed, err
+}
+
+func (h *connHealth) String() string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	switch {
+	case h.since.IsZero():
+		return "CONNECTING"
+	case !h.connected:
+		return fmt.Sprintf("DISCONNECTED since %s (%v)", h.since.In(common.NowHere().Location()).Format("15:04"), h.err)
+	case !h.subscribed:
+		return "CONNECTED, NOT SUBSCRIBED"
+	default:
+		return fmt.Sprintf("CONNECTED since %s", h.since.In(common.NowHere().Location()).Format("15:04"))
+	}
+}
+
+func PollMqtt(chfax chan bool, mqttcfg *common.MqttConfig, opener *common.FaxOpener, spool *common.Spool, seen *common.SeenIDs) {
+	onFax := func(client mqtt.Client, msg mqtt.Message) {
+		// Decrypt and authenticate the fax before accepting it into the spool
+		payload, err := opener.Open(msg.Payload())
+		if err != nil {
+			log.Printf("[ERROR] rejecting MQTT message: %v", err)
+			return
+		}
+		env, err := common.DecodeEnvelope(payload)
+		if err != nil {
+			log.Printf("[ERROR] rejecting MQTT message: %v", err)
+			return
+		}
+		// The same fax might be delivered more than once (and older
+		// backends don't send IDs, so just hope for the best)
+		if env.ID != "" && seen.Seen(env.ID) {
+			log.Printf("[INFO] discarding duplicate fax %s", env.ID)
+			return
+		}
+		publishFaxStatus(env.ID, common.FaxReceived, "")
+
+		e, err := spool.Add(env.ID, payload)
+		if err != nil {
+			log.Printf("[ERROR] cannot write spool file: %v", err)
+			publishFaxStatus(env.ID, common.FaxFailed, "cannot write to spool")
+			return
+		}
+		log.Printf("[DEBUG] got MQTT message, spooled as %s", e.Name)
+		if env.ID != "" {
+			if err := seen.Add(env.ID); err != nil {
+				log.Printf("[ERROR] cannot save seen faxes: %v", err)
+			}
+		}
+		publishFaxStatus(env.ID, common.FaxSpooled, "")
+		wakeup(chfax)
+	}
+
+	// After the first connection, the MQTT client reconnects by itself;
+	// subscribe again each time, in case the server forgot the session.
+	mqttcfg.OnConnect = func(c mqtt.Client) {
+		log.Printf("[INFO] connected to MQTT server")
+		mqttHealth.set(true, false, nil)
+		go subscribeFaxes(c, onFax)
+		go publishPresence(c, spool)
+	}
+	mqttcfg.OnConnectionLost = func(c mqtt.Client, err error) {
+		log.Printf("[ERROR] lost connection to MQTT server: %v", err)
+		mqttHealth.set(false, false, err)
+		common.StartBlinkingRed()
+	}
+
+	// Keep in-flight messages in the spool area, so that QoS 2 delivery
+	// survives a power cycle
+	mqttcfg.Store = common.NewSyncFileStore(spool.Dir + "/mqtt")
+
+	// Let the backend know when the device goes offline
+	mqttcfg.WillTopic = common.PresenceTopic(DeviceId)
+	mqttcfg.WillPayload = offlinePresence()
+	mqttcfg.WillRetained = true
+
+	// A single client is used for all the attempts: a connection attempt
+	// that is slow to complete must not race with a new client with the
+	// same ID, or the broker would keep kicking one out for the other.
+	c, err := common.CreateMqttClient(DeviceId, mqttcfg)
+	if err != nil {
+		log.Fatalf("invalid MQTT configuration: %v", err)
+	}
+	sleep := 5 * time.Second
+	token, slow := c.Connect(), false
+	for {
+		if !token.WaitTimeout(3 * time.Second) {
+			// Still trying: wait for the same attempt to complete
+			if !slow {
+				err = errors.New("timeout while connecting to CloudMQTT")
+				mqttHealth.set(false, false, err)
+				common.StartBlinkingRed()
+				log.Printf("[INFO] cannot connect to MQTT server: %v, still waiting...", err)
+				slow = true
+			}
+			continue
+		}
+		if err = token.Error(); err == nil {
+			setStatusClient(c)
+			go heartbeat(c, spool)
+			break
+		}
+		mqttHealth.set(false, false, err)
+		common.StartBlinkingRed()
+		log.Printf("[INFO] cannot connect to MQTT server: %v", err)
+		log.Printf("[INFO] retrying in %v...", sleep)
+		time.Sleep(sleep)
+		sleep = sleep + sleep/3
+		if sleep > 5*time.Minute {
+			sleep = 5 * time.Minute
+		}
+		token, slow = c.Connect(), false
+	}
+}
+
+// subscribeFaxes subscribes to the fax topic, retrying until it succeeds or
+// the connection is lost.
+func subscribeFaxes(c mqtt.Client, onFax mqtt.MessageHandler) {
+	topic := common.FaxTopic(DeviceId)
+	for c.IsConnected() {
+		token := c.Subscribe(topic, ClientMqttQos, onFax)
+		if !token.WaitTimeout(10 * time.Second) {
+			log.Printf("[ERROR] timeout subscribing to %s, retrying...", topic)
+			continue
+		}
+		if err := token.Error(); err != nil {
+			log.Printf("[ERROR] cannot subscribe to %s: %v, retrying...", topic, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		log.Printf("[INFO] subscribed to %s, start polling", topic)
+		mqttHealth.set(true, true, nil)
+		common.StopBlinking()
+		return
+	}
+}
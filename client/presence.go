@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rasky/CryptoFaxPA/common"
+	"github.com/vmihailenco/msgpack"
+)
+
+var startTime = time.Now()
+
+// uptime returns the uptime of the system (or of the client, if unknown).
+func uptime() time.Duration {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err == nil {
+		if f := strings.Fields(string(data)); len(f) > 0 {
+			if secs, err := strconv.ParseFloat(f[0], 64); err == nil {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return time.Since(startTime)
+}
+
+// offlinePresence is set as MQTT last will, so that the server tells
+// everybody when the device disconnects.
+func offlinePresence() []byte {
+	payload, err := msgpack.Marshal(&common.DevicePresence{
+		Device:    DeviceId,
+		Online:    false,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		panic(err) // programming error, structure not marshalable
+	}
+	return payload
+}
+
+// publishPresence publishes the (retained) online presence of the device.
+func publishPresence(c mqtt.Client, spool *common.Spool) {
+	p := common.DevicePresence{
+		Device:    DeviceId,
+		Online:    true,
+		Version:   common.FirmwareVersion(),
+		Uptime:    uptime(),
+		Timestamp: time.Now(),
+	}
+	if n, _, err := spool.Pending(); err == nil {
+		p.Spool = n
+	}
+	if iif := common.DefaultInterface(); iif != "" {
+		p.Network = iif.Name()
+		p.Signal = common.SignalStrength(iif)
+	}
+
+	payload, err := msgpack.Marshal(&p)
+	if err != nil {
+		panic(err) // programming error, structure not marshalable
+	}
+	token := c.Publish(common.PresenceTopic(DeviceId), 1, true, payload)
+	if !token.WaitTimeout(30*time.Second) || token.Error() != nil {
+		log.Printf("[ERROR] cannot publish presence: %v", token.Error())
+	}
+}
+
+// heartbeat publishes the presence every common.PresenceInterval, while
+// connected.
+func heartbeat(c mqtt.Client, spool *common.Spool) {
+	for range time.Tick(common.PresenceInterval) {
+		if c.IsConnected() {
+			publishPresence(c, spool)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rasky/CryptoFaxPA/common"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// checkGolden prints to a virtual printer, and compares the printed paper
+// with testdata/<name>.png. Run "go test -update" to regenerate the golden
+// files after an intended change, and check them by eye.
+func checkGolden(t *testing.T, name string, print func()) {
+	vp := common.NewVirtualPrinter()
+	defer func(p common.Printer) { common.DefaultPrinter = p }(common.DefaultPrinter)
+	common.DefaultPrinter = vp
+
+	print()
+	got := vp.Image()
+
+	golden := filepath.Join("testdata", name+".png")
+	if *update {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, got); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	f, err := os.Open(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	exp, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Bounds() != exp.Bounds() {
+		t.Fatalf("%s: invalid paper size: got %v, exp %v", name, got.Bounds(), exp.Bounds())
+	}
+	diff := 0
+	b := got.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			black := color.GrayModel.Convert(exp.At(x, y)).(color.Gray).Y < 128
+			if black != (got.ColorIndexAt(x, y) == 1) {
+				diff++
+			}
+		}
+	}
+	if diff != 0 {
+		t.Errorf("%s: %d dots differ from %s", name, diff, golden)
+	}
+}
+
+// testImage returns a PNG image with a gradient and a diagonal line.
+func testImage(w, h int) []byte {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetGray(x, y, color.Gray{uint8(255 * x / w)})
+		}
+		img.SetGray(y*w/h, y, color.Gray{0})
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func TestPrintFax(t *testing.T) {
+	fax := &common.Fax{
+		Sender:    "Diego",
+		Timestamp: time.Date(2018, 10, 1, 10, 30, 0, 0, time.UTC),
+		Message:   "*Ciao* team! Here's the _new_ `fax` layout:\n- bullets\n- and wrapping of long lines, with a https://example.com/very/long/url",
+		Picture:   testImage(200, 60),
+	}
+	checkGolden(t, "fax", func() { print_fax(fax) })
+}
+
+func TestPrintHelp(t *testing.T) {
+	network := []string{
+		"GSM / UMTS <eth1>: DISCONNECTED []",
+		"Wi-Fi <wlan0>: CONNECTED [192.168.1.10] (CryptoNet)",
+		"Ethernet <eth0>: DISCONNECTED []",
+	}
+	checkGolden(t, "help", func() { print_help_page(network) })
+}
+
+func TestPrintBlockchain(t *testing.T) {
+	now := time.Date(2018, 10, 1, 10, 30, 0, 0, time.UTC)
+	infos := []common.BlockchainNerdInfo{
+		{Name: "Current BTC price (USD)", Value: "$6,612.51"},
+		{Name: "Current block height", Value: "544,142"},
+		{Name: "Latest hash", Value: "0000000000000000001c4b0fb4e5fb3b5d7e2b8b30b5ac3d1bd0d1f70e1a7c8e"},
+	}
+	graphs := []common.PriceGraph{{Title: "BITCOIN LIVE EXCHANGE (USD)", PNG: testImage(360, 80)}}
+	snap := &common.BlockchainSnapshot{Time: now, Infos: infos, Graphs: graphs}
+	checkGolden(t, "blockchain", func() { print_blockchain_page(now, snap, false) })
+	checkGolden(t, "blockchain_offline", func() { print_blockchain_page(now, nil, true) })
+
+	// Last known data
+	checkGolden(t, "blockchain_snapshot", func() { print_blockchain_page(now.Add(3*time.Hour), snap, true) })
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rasky/CryptoFaxPA/common"
+	"github.com/vmihailenco/msgpack"
+)
+
+var (
+	statusLock   sync.Mutex
+	statusClient mqtt.Client
+)
+
+func setStatusClient(c mqtt.Client) {
+	statusLock.Lock()
+	statusClient = c
+	statusLock.Unlock()
+}
+
+// publishFaxStatus sends a delivery receipt for the specified fax to the
+// backend. It never blocks: receipts are best-effort, and a failure to send
+// them must not hold up printing.
+func publishFaxStatus(id string, status common.FaxStatusCode, reason string) {
+	if id == "" {
+		return // fax from an older backend, nobody is waiting for receipts
+	}
+
+	statusLock.Lock()
+	c := statusClient
+	statusLock.Unlock()
+	if c == nil {
+		log.Printf("[ERROR] cannot send status %q for fax %s: not connected", status, id)
+		return
+	}
+
+	payload, err := msgpack.Marshal(&common.FaxStatus{
+		ID:        id,
+		Device:    DeviceId,
+		Status:    status,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		panic(err) // programming error, structure not marshalable
+	}
+
+	token := c.Publish(common.FaxStatusTopic(DeviceId), 1, false, payload)
+	go func() {
+		if token.WaitTimeout(30*time.Second) && token.Error() == nil {
+			return
+		}
+		log.Printf("[ERROR] cannot send status %q for fax %s: %v", status, id, token.Error())
+	}()
+}
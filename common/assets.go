@@ -0,0 +1,125 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	humanize "github.com/dustin/go-humanize"
+)
+
+// Asset is a coin followed in the blockchain report.
+type Asset struct {
+	Symbol    string // eg: "BTC"
+	Name      string // eg: "Bitcoin"
+	CoinGecko string // id of the coin in the CoinGecko API
+	Decimals  int    // of the smallest unit (8 for satoshis)
+}
+
+// Amount formats an amount of the asset down to its smallest unit.
+func (a *Asset) Amount(v float64) string {
+	return fmt.Sprintf("%.*f %s", a.Decimals, v, a.Symbol)
+}
+
+var Assets = map[string]*Asset{
+	"BTC":  {Symbol: "BTC", Name: "Bitcoin", CoinGecko: "bitcoin", Decimals: 8},
+	"BCH":  {Symbol: "BCH", Name: "Bitcoin Cash", CoinGecko: "bitcoin-cash", Decimals: 8},
+	"ETH":  {Symbol: "ETH", Name: "Ethereum", CoinGecko: "ethereum", Decimals: 18},
+	"LTC":  {Symbol: "LTC", Name: "Litecoin", CoinGecko: "litecoin", Decimals: 8},
+	"XRP":  {Symbol: "XRP", Name: "XRP", CoinGecko: "ripple", Decimals: 6},
+	"DOGE": {Symbol: "DOGE", Name: "Dogecoin", CoinGecko: "dogecoin", Decimals: 8},
+}
+
+// Currency is a quote currency of the report.
+type Currency struct {
+	Code      string // ISO 4217, eg: "USD"
+	Symbol    string // printed before amounts; must be in CodePage437
+	Thousands string // separators
+	Decimal   string
+	Decimals  int // printed for prices
+}
+
+// Format formats a price.
+func (c *Currency) Format(v float64) string {
+	return c.format(v, c.Decimals)
+}
+
+// FormatRound formats a large amount (eg: a market cap), without decimals.
+func (c *Currency) FormatRound(v float64) string {
+	return c.format(v, 0)
+}
+
+func (c *Currency) format(v float64, decimals int) string {
+	// See humanize.FormatFloat: "#,###.##" has both separators and the
+	// number of decimals
+	format := "#" + c.Thousands + "###" + c.Decimal + strings.Repeat("#", decimals)
+	return c.Symbol + humanize.FormatFloat(format, v)
+}
+
+var Currencies = map[string]*Currency{
+	"USD": {Code: "USD", Symbol: "$", Thousands: ",", Decimal: ".", Decimals: 2},
+	"EUR": {Code: "EUR", Symbol: "EUR ", Thousands: ".", Decimal: ",", Decimals: 2}, // no € in CodePage437
+	"GBP": {Code: "GBP", Symbol: "£", Thousands: ",", Decimal: ".", Decimals: 2},
+	"CHF": {Code: "CHF", Symbol: "CHF ", Thousands: "'", Decimal: ".", Decimals: 2},
+	"JPY": {Code: "JPY", Symbol: "¥", Thousands: ",", Decimal: ".", Decimals: 0},
+}
+
+// MarketAssets are the assets in the report, configured with the
+// MARKET_ASSETS environment variable (eg: "BTC,ETH"; default: "BTC").
+var MarketAssets = defaultMarketAssets()
+
+// MarketCurrencies are the quote currencies of the report, configured with
+// the MARKET_CURRENCIES environment variable (eg: "EUR,USD"; default: "USD").
+// The first one is used for the charts.
+var MarketCurrencies = defaultMarketCurrencies()
+
+func defaultMarketAssets() []*Asset {
+	assets, err := ParseAssets(os.Getenv("MARKET_ASSETS"))
+	if err != nil {
+		log.Printf("[ERROR] MARKET_ASSETS: %v", err)
+		assets, _ = ParseAssets("")
+	}
+	return assets
+}
+
+func defaultMarketCurrencies() []*Currency {
+	currencies, err := ParseCurrencies(os.Getenv("MARKET_CURRENCIES"))
+	if err != nil {
+		log.Printf("[ERROR] MARKET_CURRENCIES: %v", err)
+		currencies, _ = ParseCurrencies("")
+	}
+	return currencies
+}
+
+// ParseAssets parses a comma-separated list of asset symbols.
+func ParseAssets(spec string) ([]*Asset, error) {
+	if spec == "" {
+		spec = "BTC"
+	}
+	var assets []*Asset
+	for _, sym := range strings.Split(spec, ",") {
+		a, found := Assets[strings.ToUpper(strings.TrimSpace(sym))]
+		if !found {
+			return nil, fmt.Errorf("unknown asset: %q", sym)
+		}
+		assets = append(assets, a)
+	}
+	return assets, nil
+}
+
+// ParseCurrencies parses a comma-separated list of currency codes.
+func ParseCurrencies(spec string) ([]*Currency, error) {
+	if spec == "" {
+		spec = "USD"
+	}
+	var currencies []*Currency
+	for _, code := range strings.Split(spec, ",") {
+		c, found := Currencies[strings.ToUpper(strings.TrimSpace(code))]
+		if !found {
+			return nil, fmt.Errorf("unknown currency: %q", code)
+		}
+		currencies = append(currencies, c)
+	}
+	return currencies, nil
+}
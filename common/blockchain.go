@@ -2,172 +2,252 @@ package common
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io"
+	"image/png"
+	"io/ioutil"
 	"log"
-	"net/http"
-	"sort"
-	"strconv"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/antonholmquist/jason"
 	humanize "github.com/dustin/go-humanize"
 	"github.com/guptarohit/asciigraph"
-	chart "github.com/wcharczuk/go-chart"
 )
 
-type Elem struct {
-	t time.Time
-	v float64
+// PriceGraph is the price chart of an asset over the MarketChartRange, in
+// the first of the MarketCurrencies.
+type PriceGraph struct {
+	Title   string // eg: "BITCOIN LIVE EXCHANGE (USD)"
+	History []PricePoint
+	PNG     []byte // see GetPriceGraphs
+	Text    string // see GetAsciiPriceGraphs
 }
 
-func getCoindeskData() []Elem {
-	res, err := http.Get("https://api.coindesk.com/v1/bpi/historical/close.json")
-	if err != nil {
-		log.Printf("[ERROR] coinbase: cannot fetch JSON: %v", err)
-		return nil
-	}
-	defer res.Body.Close()
-
-	v, err := jason.NewObjectFromReader(res.Body)
-	if err != nil {
-		log.Printf("[ERROR] coinbase: cannot unmarshal bitcoin JSON: %v", err)
-		return nil
+// priceGraphs fetches the price history of all the assets in parallel, and
+// draws the graphs of those that are available.
+func priceGraphs(ctx context.Context, draw func(g *PriceGraph, history []PricePoint, c *Currency)) []PriceGraph {
+	c := MarketCurrencies[0]
+	graphs := make([]PriceGraph, len(MarketAssets))
+	ok := make([]bool, len(MarketAssets))
+	var wg sync.WaitGroup
+	for i, a := range MarketAssets {
+		wg.Add(1)
+		go func(i int, a *Asset) {
+			defer wg.Done()
+			history, err := GetPriceHistory(ctx, a, c, MarketChartRange)
+			if err != nil {
+				log.Printf("[ERROR] cannot get %s price history: %v", a.Name, err)
+				return
+			}
+			graphs[i].Title = fmt.Sprintf("%s LIVE EXCHANGE (%s)", strings.ToUpper(a.Name), c.Code)
+			graphs[i].History = history
+			draw(&graphs[i], history, c)
+			ok[i] = true
+		}(i, a)
 	}
+	wg.Wait()
 
-	bpi, err := v.GetObject("bpi")
-	if err != nil {
-		log.Printf("[ERROR] coinbase: cannot decode JSON API")
-		return nil
+	var res []PriceGraph
+	for i := range graphs {
+		if ok[i] {
+			res = append(res, graphs[i])
+		}
 	}
+	return res
+}
 
-	var elems []Elem
-	for jt, jv := range bpi.Map() {
-		t, err := time.Parse("2006-01-02", jt)
-		if err != nil {
-			continue
+// GetPriceGraphs returns the graphs in PNG format, drawn for the printer
+// (see Chart).
+func GetPriceGraphs(ctx context.Context) []PriceGraph {
+	return priceGraphs(ctx, func(g *PriceGraph, history []PricePoint, c *Currency) {
+		img := NewChart(MarketChartRange, MarketChartMode, c).Render(history)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			log.Printf("[ERROR] cannot encode graph: %v", err)
+			return
 		}
-		v, err := jv.Float64()
-		if err != nil {
-			continue
+		g.PNG = buf.Bytes()
+	})
+}
+
+// GetAsciiPriceGraphs returns the graphs as text.
+func GetAsciiPriceGraphs(ctx context.Context, width, height int) []PriceGraph {
+	return priceGraphs(ctx, func(g *PriceGraph, history []PricePoint, c *Currency) {
+		var values []float64
+		for _, e := range history {
+			values = append(values, e.Price)
 		}
+		g.Text = asciigraph.Plot(values, asciigraph.Width(width), asciigraph.Height(height),
+			asciigraph.Caption(c.Code))
+	})
+}
 
-		elems = append(elems, Elem{t, v})
-	}
+type BlockchainNerdInfo struct {
+	Name  string
+	Value string
+	Error string // why the value is unknown, if it is
+}
 
-	sort.Slice(elems, func(i, j int) bool {
-		return elems[i].t.Before(elems[j].t)
-	})
-	return elems
+func seconds(d time.Duration) string {
+	return d.Round(time.Second).String()
 }
 
-// Return a graph in PNG format representing the 1-month BTC-USD exchange
-func GetBitcoinGraph() []byte {
-	elems := getCoindeskData()
-	if elems == nil {
-		return nil
-	}
-
-	var times []time.Time
-	var values []float64
-
-	for _, e := range elems {
-		times = append(times, e.t)
-		values = append(values, e.v)
-	}
-
-	graph := chart.Chart{
-		Width:  360,
-		Height: 180,
-		XAxis: chart.XAxis{
-			Style: chart.Style{
-				Show: true,
-			},
-		},
-		YAxis: chart.YAxis{
-			Style: chart.Style{
-				Show: true,
-			},
-		},
-		Series: []chart.Series{
-			chart.TimeSeries{
-				XValues: times,
-				YValues: values,
-			},
-		},
-	}
-
-	var buf bytes.Buffer
-	graph.Render(chart.PNG, &buf)
-	return buf.Bytes()
+func human(v float64) string {
+	return humanize.Comma(int64(v))
 }
 
-func GetBitcoinAsciiGraph(width, height int) string {
-	elems := getCoindeskData()
-	if elems == nil {
-		return ""
+// GetBlockchainNerdInfos returns the data for the blockchain report, for
+// all the MarketAssets and MarketCurrencies. Values unknown to all the
+// providers are reported as "n/a", together with the errors of the
+// providers that should have known them; values that no provider supports
+// (eg: the network data of assets other than Bitcoin) are omitted.
+func GetBlockchainNerdInfos(ctx context.Context) ([]BlockchainNerdInfo, error) {
+	type result struct {
+		data *MarketData
+		err  error
+	}
+	results := make([][]result, len(MarketAssets))
+	var wg sync.WaitGroup
+	for i, a := range MarketAssets {
+		results[i] = make([]result, len(MarketCurrencies))
+		for j, c := range MarketCurrencies {
+			wg.Add(1)
+			go func(r *result, a *Asset, c *Currency) {
+				defer wg.Done()
+				r.data, r.err = GetMarketData(ctx, a, c)
+			}(&results[i][j], a, c)
+		}
 	}
+	wg.Wait()
+
+	var infos []BlockchainNerdInfo
+	var errs []string
+	for i, a := range MarketAssets {
+		for j, c := range MarketCurrencies {
+			r := results[i][j]
+			if r.err != nil {
+				errs = append(errs, r.err.Error())
+				r.data = &MarketData{Errors: map[string]string{"Price": r.err.Error(), "MarketCap": r.err.Error()}}
+			}
+			info := infoAdder(&infos, r.data)
+			info(fmt.Sprintf("Current %s price (%s)", a.Symbol, c.Code), "Price", r.data.Price != 0, c.Format(r.data.Price))
+			info(fmt.Sprintf("%s market cap (%s)", a.Symbol, c.Code), "MarketCap", r.data.MarketCap != 0, c.FormatRound(r.data.MarketCap))
+		}
 
-	var values []float64
-	for _, e := range elems {
-		values = append(values, e.v)
+		// The network data doesn't depend on the currency
+		var data *MarketData
+		for j := len(MarketCurrencies) - 1; j >= 0; j-- {
+			if results[i][j].data != nil {
+				data = results[i][j].data
+			}
+		}
+		if data == nil {
+			continue
+		}
+		info := infoAdder(&infos, data)
+		info("Global hash rate (GigaHash)", "HashRate", data.HashRate != 0, human(data.HashRate))
+		info("Current difficulty target", "Difficulty", data.Difficulty != 0, human(data.Difficulty))
+		info("Current block height", "BlockHeight", data.BlockHeight != 0, fmt.Sprint(data.BlockHeight))
+		info("Latest hash", "LatestHash", data.LatestHash != "", data.LatestHash)
+		info("Current block reward", "BlockReward", data.BlockReward != 0, a.Amount(data.BlockReward))
+		info(fmt.Sprintf("Total coins (%s)", a.Symbol), "TotalCoins", data.TotalCoins != 0, a.Amount(data.TotalCoins))
+		info("Probability of mining", "Probability", data.Probability != 0, fmt.Sprint(data.Probability))
+		info("ETA until next block", "NextBlock", data.NextBlock != 0, seconds(data.NextBlock))
+	}
+	if len(errs) == len(MarketAssets)*len(MarketCurrencies) {
+		return nil, fmt.Errorf("no market data available (%s)", strings.Join(errs, "; "))
 	}
+	return infos, nil
+}
 
-	return asciigraph.Plot(values, asciigraph.Width(width), asciigraph.Height(height))
+// infoAdder returns a function that appends to infos the value of a field of
+// data, if it is either known or expected.
+func infoAdder(infos *[]BlockchainNerdInfo, data *MarketData) func(name, field string, known bool, value string) {
+	return func(name, field string, known bool, value string) {
+		if known {
+			*infos = append(*infos, BlockchainNerdInfo{Name: name, Value: value})
+		} else if err, found := data.Errors[field]; found {
+			*infos = append(*infos, BlockchainNerdInfo{Name: name, Value: "n/a", Error: err})
+		}
+	}
 }
 
-type BlockchainNerdInfo struct {
-	Name  string
-	Value string
+// BlockchainSnapshot is a complete blockchain report, kept on disk to be
+// printed when there's no connection.
+type BlockchainSnapshot struct {
+	Time   time.Time // when the data was fetched
+	Infos  []BlockchainNerdInfo
+	Graphs []PriceGraph
 }
 
-func httpGetString(url string, outerr *error) string {
-	res, err := http.Get(url)
+// GetBlockchainSnapshot fetches the nerd infos and the graphs in PNG format
+// at once. It fails if the infos are not available at all.
+func GetBlockchainSnapshot(ctx context.Context) (*BlockchainSnapshot, error) {
+	var graphs []PriceGraph
+	done := make(chan bool)
+	go func() {
+		graphs = GetPriceGraphs(ctx)
+		close(done)
+	}()
+	infos, err := GetBlockchainNerdInfos(ctx)
+	<-done
 	if err != nil {
-	    *outerr = err
-		return ""
+		return nil, err
 	}
-	var buf bytes.Buffer
-	io.Copy(&buf, res.Body)
-	res.Body.Close()
-	return buf.String()
+	return &BlockchainSnapshot{Time: time.Now(), Infos: infos, Graphs: graphs}, nil
 }
 
-func satoshis(s string) string {
-	v, err := strconv.ParseInt(s, 10, 64)
-	if err == nil {
-		return fmt.Sprintf("%.8f", float64(v)/float64(100000000))
+// Complete returns true if the snapshot has all the infos and graphs, that
+// is if it can replace a previous one without losing anything.
+func (s *BlockchainSnapshot) Complete() bool {
+	for _, info := range s.Infos {
+		if info.Error != "" {
+			return false
+		}
 	}
-	return s
+	return len(s.Graphs) == len(MarketAssets)
 }
 
-func seconds(s string) string {
-	v, err := strconv.ParseFloat(s, 64)
-	if err == nil {
-		return fmt.Sprintf("%v", time.Duration(v*1000000000))
+func LoadBlockchainSnapshot(path string) (*BlockchainSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snap BlockchainSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
 	}
-	return s
+	return &snap, nil
 }
 
-func human(s string) string {
-	v, err := strconv.ParseFloat(s, 64)
+// Save writes the snapshot to path, replacing the previous one only once
+// the new one is safely on disk. Each save has its own temporary file, so
+// that concurrent saves (eg: a refresh while printing) don't mix up.
+func (s *BlockchainSnapshot) Save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Sync(); err == nil {
+		err = err1
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
 	if err == nil {
-		return fmt.Sprintf("%v", humanize.Comma(int64(v)))
+		err = os.Rename(f.Name(), path)
 	}
-	return s
-}
-
-func GetBlockchainNerdInfos() (infos []BlockchainNerdInfo, err error) {
-	return []BlockchainNerdInfo{
-		{Name: "Current BTC price (USD)", Value: "$" + httpGetString("https://blockchain.info/q/24hrprice", &err)},
-		{Name: "Market cap (USD)", Value: "$" + human(httpGetString("https://blockchain.info/q/marketcap", &err))},
-		{Name: "Global hash rate (GigaHash)", Value: human(httpGetString("https://blockchain.info/q/hashrate", &err))},
-		{Name: "Current difficulty target", Value: human(httpGetString("https://blockchain.info/q/getdifficulty", &err))},
-		{Name: "Current block height", Value: httpGetString("https://blockchain.info/q/getblockcount", &err)},
-		{Name: "Latest hash", Value: httpGetString("https://blockchain.info/q/latesthash", &err)},
-		{Name: "Current block reward", Value: satoshis(httpGetString("https://blockchain.info/q/bcperblock", &err))},
-		{Name: "Total bitcoins", Value: satoshis(httpGetString("https://blockchain.info/q/totalbc", &err))},
-		{Name: "Probability of mining", Value: httpGetString("https://blockchain.info/q/probability", &err)},
-		{Name: "ETA until next block", Value: seconds(httpGetString("https://blockchain.info/q/eta", &err))},
-	}, err
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
 }
@@ -0,0 +1,472 @@
+package common
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/image/font/basicfont"
+)
+
+// ChartRange is the time range of a price chart.
+type ChartRange string
+
+const (
+	ChartRange24h ChartRange = "24h"
+	ChartRange7d  ChartRange = "7d"
+	ChartRange30d ChartRange = "30d"
+	ChartRange1y  ChartRange = "1y"
+)
+
+// ChartRanges lists all the available time ranges.
+var ChartRanges = []ChartRange{ChartRange24h, ChartRange7d, ChartRange30d, ChartRange1y}
+
+// ParseChartRange returns the time range with the specified name.
+func ParseChartRange(name string) (ChartRange, error) {
+	for _, r := range ChartRanges {
+		if string(r) == name {
+			return r, nil
+		}
+	}
+	return "", fmt.Errorf("unknown chart range: %q", name)
+}
+
+// Days is the length of the range in days, as used by the provider APIs.
+func (r ChartRange) Days() int {
+	switch r {
+	case ChartRange24h:
+		return 1
+	case ChartRange7d:
+		return 7
+	case ChartRange1y:
+		return 365
+	default:
+		return 30
+	}
+}
+
+func (r ChartRange) Duration() time.Duration {
+	return time.Duration(r.Days()) * 24 * time.Hour
+}
+
+// Period is the time covered by each candle.
+func (r ChartRange) Period() time.Duration {
+	switch r {
+	case ChartRange24h:
+		return time.Hour
+	case ChartRange7d:
+		return 6 * time.Hour
+	case ChartRange1y:
+		return 7 * 24 * time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+// timeFormat is the format of the dates on the time axis.
+func (r ChartRange) timeFormat() string {
+	switch r {
+	case ChartRange24h:
+		return "15:04"
+	case ChartRange1y:
+		return "Jan 06"
+	default:
+		return "Jan 2"
+	}
+}
+
+// ChartMode is how prices are drawn.
+type ChartMode string
+
+const (
+	ChartLine        ChartMode = "line"        // thick line, hatched below
+	ChartCandlestick ChartMode = "candlestick" // hollow candles when rising, filled when falling
+	ChartOHLC        ChartMode = "ohlc"        // bars with open and close ticks
+)
+
+// ChartModes lists all the available modes.
+var ChartModes = []ChartMode{ChartLine, ChartCandlestick, ChartOHLC}
+
+// ParseChartMode returns the mode with the specified name.
+func ParseChartMode(name string) (ChartMode, error) {
+	for _, m := range ChartModes {
+		if string(m) == name {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown chart mode: %q", name)
+}
+
+// MarketChartRange and MarketChartMode select the charts of the report,
+// configured with the MARKET_CHART_RANGE (default: "30d") and
+// MARKET_CHART_MODE (default: "line") environment variables.
+var (
+	MarketChartRange = defaultChartRange()
+	MarketChartMode  = defaultChartMode()
+)
+
+func defaultChartRange() ChartRange {
+	name := os.Getenv("MARKET_CHART_RANGE")
+	if name == "" {
+		return ChartRange30d
+	}
+	r, err := ParseChartRange(name)
+	if err != nil {
+		log.Printf("[ERROR] MARKET_CHART_RANGE: %v", err)
+		return ChartRange30d
+	}
+	return r
+}
+
+func defaultChartMode() ChartMode {
+	name := os.Getenv("MARKET_CHART_MODE")
+	if name == "" {
+		return ChartLine
+	}
+	m, err := ParseChartMode(name)
+	if err != nil {
+		log.Printf("[ERROR] MARKET_CHART_MODE: %v", err)
+		return ChartLine
+	}
+	return m
+}
+
+// Candle summarizes the prices of a period.
+type Candle struct {
+	Time                   time.Time // start of the period
+	Open, High, Low, Close float64
+}
+
+// Candles groups the prices into candles of the specified period. Each
+// candle opens at the close of the previous one, so that candles made of a
+// single price (eg: daily prices in daily candles) are still meaningful.
+func Candles(history []PricePoint, period time.Duration) []Candle {
+	var candles []Candle
+	for _, p := range history {
+		t := p.Time.Truncate(period)
+		n := len(candles)
+		if n > 0 && candles[n-1].Time.Equal(t) {
+			c := &candles[n-1]
+			c.High = math.Max(c.High, p.Price)
+			c.Low = math.Min(c.Low, p.Price)
+			c.Close = p.Price
+			continue
+		}
+		c := Candle{Time: t, Open: p.Price, High: p.Price, Low: p.Price, Close: p.Price}
+		if n > 0 {
+			c.Open = candles[n-1].Close
+			c.High = math.Max(c.High, c.Open)
+			c.Low = math.Min(c.Low, c.Open)
+		}
+		candles = append(candles, c)
+	}
+	return candles
+}
+
+// Chart renders price charts for the printer. Everything is drawn directly
+// in black and white at the resolution of the printer: there are no shades
+// of gray for the dithering to turn into noise, and lines are thick enough
+// to survive thermal printing.
+type Chart struct {
+	Width, Height int // dots
+	Range         ChartRange
+	Mode          ChartMode
+	Currency      *Currency
+}
+
+func NewChart(r ChartRange, m ChartMode, c *Currency) *Chart {
+	return &Chart{Width: PrinterDots, Height: 200, Range: r, Mode: m, Currency: c}
+}
+
+// canvas draws black dots on a monochrome image (see MonoPalette).
+type canvas struct {
+	img *image.Paletted
+}
+
+func (c canvas) set(x, y int) {
+	if (image.Point{x, y}).In(c.img.Rect) {
+		c.img.SetColorIndex(x, y, 1)
+	}
+}
+
+func (c canvas) fill(r image.Rectangle, index uint8) {
+	r = r.Intersect(c.img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c.img.SetColorIndex(x, y, index)
+		}
+	}
+}
+
+func (c canvas) outline(r image.Rectangle) {
+	c.fill(image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1), 1)
+	c.fill(image.Rect(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y), 1)
+	c.fill(image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y), 1)
+	c.fill(image.Rect(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y), 1)
+}
+
+// line draws a line with a square pen of the specified width (Bresenham).
+func (c canvas) line(p0, p1 image.Point, width int) {
+	dx, dy := abs(p1.X-p0.X), -abs(p1.Y-p0.Y)
+	sx, sy := 1, 1
+	if p0.X > p1.X {
+		sx = -1
+	}
+	if p0.Y > p1.Y {
+		sy = -1
+	}
+	pen := image.Rect(-width/2, -width/2, width-width/2, width-width/2)
+	for err := dx + dy; ; {
+		c.fill(pen.Add(p0), 1)
+		if p0 == p1 {
+			return
+		}
+		if e2 := 2 * err; e2 >= dy {
+			err += dy
+			p0.X += sx
+		} else if e2 <= dx {
+			err += dx
+			p0.Y += sy
+		}
+	}
+}
+
+// text draws a string with the top-left corner in (x, y), with the font of
+// the virtual printer.
+func (c canvas) text(x, y int, s string) {
+	for _, r := range s {
+		g := glyph(r)
+		b := g.Bounds()
+		for gy := b.Min.Y; gy < b.Max.Y; gy++ {
+			for gx := b.Min.X; gx < b.Max.X; gx++ {
+				if g.AlphaAt(gx, gy).A >= 0x80 {
+					c.set(x+gx, y+gy)
+				}
+			}
+		}
+		x += basicfont.Face7x13.Advance
+	}
+}
+
+func textWidth(s string) int {
+	return utf8.RuneCountInString(s) * basicfont.Face7x13.Advance
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// chartDecimals returns the decimals needed to tell apart prices within a
+// span (eg: none for Bitcoin, more for cheap coins).
+func chartDecimals(span float64) int {
+	d := 0
+	for span > 0 && span < 10 && d < 6 {
+		span *= 10
+		d++
+	}
+	return d
+}
+
+// Render draws the chart of the prices, which must be sorted by time; only
+// the prices within the range from the last one are drawn.
+func (ch *Chart) Render(history []PricePoint) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, ch.Width, ch.Height), MonoPalette)
+	cv := canvas{img}
+	lineh := basicfont.Face7x13.Height
+
+	if n := len(history); n > 0 {
+		start := history[n-1].Time.Add(-ch.Range.Duration())
+		history = history[sort.Search(n, func(i int) bool { return !history[i].Time.Before(start) }):]
+	}
+	if len(history) < 2 {
+		msg := "No price history"
+		cv.text((ch.Width-textWidth(msg))/2, (ch.Height-lineh)/2, msg)
+		return img
+	}
+
+	lo, hi := history[0].Price, history[0].Price
+	for _, p := range history {
+		lo, hi = math.Min(lo, p.Price), math.Max(hi, p.Price)
+	}
+	decimals := chartDecimals(hi - lo)
+	label := func(v float64) string { return ch.Currency.format(v, decimals) }
+
+	// Prices on the left, dates at the bottom; within the plot, leave room
+	// above and below the prices for the max and min annotations
+	ylabelw := textWidth(label(hi))
+	if w := textWidth(label(lo)); w > ylabelw {
+		ylabelw = w
+	}
+	plot := image.Rect(ylabelw+4, 2, ch.Width-1, ch.Height-lineh-4)
+	pad := lineh + 9
+	data := image.Rect(plot.Min.X+4, plot.Min.Y+pad, plot.Max.X-4, plot.Max.Y-pad)
+	y := func(v float64) int {
+		if hi == lo {
+			return (data.Min.Y + data.Max.Y) / 2
+		}
+		return data.Max.Y - int(math.Round((v-lo)/(hi-lo)*float64(data.Dy())))
+	}
+
+	// Dotted grid lines with the prices, and the axes
+	for k := 0; k <= 4; k += 2 {
+		v := lo + (hi-lo)*float64(k)/4
+		yy := y(v)
+		for x := plot.Min.X; x < plot.Max.X; x += 4 {
+			cv.set(x, yy)
+		}
+		s := label(v)
+		cv.text(plot.Min.X-4-textWidth(s), yy-lineh/2, s)
+	}
+	cv.fill(image.Rect(plot.Min.X-2, plot.Min.Y, plot.Min.X, plot.Max.Y), 1)
+	cv.fill(image.Rect(plot.Min.X-2, plot.Max.Y, plot.Max.X, plot.Max.Y+2), 1)
+
+	var minp, maxp, lastp image.Point
+	var times []time.Time
+	var xs []int
+	if ch.Mode == ChartCandlestick || ch.Mode == ChartOHLC {
+		candles := Candles(history, ch.Range.Period())
+		slot := float64(data.Dx()) / float64(len(candles))
+		body := int(slot * 0.6)
+		if body < 1 {
+			body = 1
+		}
+		for i, c := range candles {
+			cx := data.Min.X + int(slot*(float64(i)+0.5))
+			top, bottom := y(math.Max(c.Open, c.Close)), y(math.Min(c.Open, c.Close))
+			if ch.Mode == ChartCandlestick {
+				cv.line(image.Pt(cx, y(c.High)), image.Pt(cx, y(c.Low)), 1)
+				r := image.Rect(cx-body/2, top, cx-body/2+body, bottom+1)
+				if c.Close >= c.Open && body > 2 {
+					cv.fill(r, 0)
+					cv.outline(r)
+				} else {
+					cv.fill(r, 1)
+				}
+			} else {
+				width := 1
+				if slot >= 6 {
+					width = 2
+				}
+				tick := body/2 + 1
+				cv.line(image.Pt(cx, y(c.High)), image.Pt(cx, y(c.Low)), width)
+				cv.line(image.Pt(cx-tick, y(c.Open)), image.Pt(cx, y(c.Open)), 2)
+				cv.line(image.Pt(cx, y(c.Close)), image.Pt(cx+tick, y(c.Close)), 2)
+			}
+
+			if c.High == hi && maxp == (image.Point{}) {
+				maxp = image.Pt(cx, y(c.High))
+			}
+			if c.Low == lo && minp == (image.Point{}) {
+				minp = image.Pt(cx, y(c.Low))
+			}
+			lastp = image.Pt(cx, y(c.Close))
+			times, xs = append(times, c.Time), append(xs, cx)
+		}
+	} else {
+		t0, t1 := history[0].Time, history[len(history)-1].Time
+		pts := make([]image.Point, len(history))
+		for i, p := range history {
+			x := data.Min.X + int(float64(data.Dx())*float64(p.Time.Sub(t0))/float64(t1.Sub(t0)))
+			pts[i] = image.Pt(x, y(p.Price))
+			if p.Price == hi && maxp == (image.Point{}) {
+				maxp = pts[i]
+			}
+			if p.Price == lo && minp == (image.Point{}) {
+				minp = pts[i]
+			}
+			times, xs = append(times, p.Time), append(xs, x)
+		}
+		lastp = pts[len(pts)-1]
+
+		// Diagonal hatching below the line, then the line itself
+		for i := 1; i < len(pts); i++ {
+			p0, p1 := pts[i-1], pts[i]
+			for x := p0.X; x < p1.X || (i == len(pts)-1 && x == p1.X); x++ {
+				yy := p0.Y
+				if p1.X != p0.X {
+					yy += (p1.Y - p0.Y) * (x - p0.X) / (p1.X - p0.X)
+				}
+				for hy := yy + 3; hy < plot.Max.Y; hy++ {
+					if (x+hy)%5 == 0 {
+						cv.set(x, hy)
+					}
+				}
+			}
+		}
+		for i := 1; i < len(pts); i++ {
+			cv.line(pts[i-1], pts[i], 3)
+		}
+		for _, p := range []image.Point{minp, maxp, lastp} {
+			cv.fill(image.Rect(p.X-3, p.Y-3, p.X+4, p.Y+4), 1)
+		}
+	}
+
+	// Dates of the first, middle and last price
+	for i, idx := range []int{0, len(xs) / 2, len(xs) - 1} {
+		s := times[idx].Format(ch.Range.timeFormat())
+		x := xs[idx] - textWidth(s)/2
+		switch i {
+		case 0:
+			x = plot.Min.X
+		case 2:
+			x = plot.Max.X - textWidth(s)
+		}
+		cv.fill(image.Rect(xs[idx]-1, plot.Max.Y, xs[idx]+1, plot.Max.Y+5), 1)
+		cv.text(x, plot.Max.Y+4, s)
+	}
+
+	// Annotations, on a white box so that they can be read over the chart;
+	// an annotation that would cover another one is moved away
+	var boxes []image.Rectangle
+	annotate := func(p image.Point, s string, dy int) {
+		w, h := textWidth(s)+4, lineh+2
+		x := p.X - w/2
+		if dy == 0 {
+			x = p.X - 6 - w // on the left of the point
+		}
+		if x < plot.Min.X+2 {
+			x = plot.Min.X + 2
+		}
+		if x+w > plot.Max.X {
+			x = plot.Max.X - w
+		}
+		yy := p.Y - h/2
+		switch {
+		case dy < 0:
+			yy = p.Y - 5 - h
+		case dy > 0:
+			yy = p.Y + 5
+		}
+		r := image.Rect(x, yy, x+w, yy+h)
+		for tries := 0; tries < 4; tries++ {
+			overlap := false
+			for _, b := range boxes {
+				overlap = overlap || b.Overlaps(r)
+			}
+			if !overlap {
+				break
+			}
+			if dy > 0 || (dy == 0 && p.Y < (data.Min.Y+data.Max.Y)/2) {
+				r = r.Add(image.Pt(0, h))
+			} else {
+				r = r.Add(image.Pt(0, -h))
+			}
+		}
+		boxes = append(boxes, r)
+		cv.fill(r, 0)
+		cv.text(r.Min.X+2, r.Min.Y+1, s)
+	}
+	annotate(maxp, "max "+label(hi), -1)
+	annotate(minp, "min "+label(lo), 1)
+	annotate(lastp, "last "+label(history[len(history)-1].Price), 0)
+
+	return img
+}
@@ -0,0 +1,50 @@
+package common
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCandles(t *testing.T) {
+	at := func(h int) time.Time { return time.Date(2018, 10, 1, h, 0, 0, 0, time.UTC) }
+	history := []PricePoint{
+		{at(0), 10}, {at(6), 14}, {at(12), 8}, {at(18), 12},
+		{at(24), 13},
+		{at(48), 11}, {at(60), 15},
+	}
+	exp := []Candle{
+		{at(0), 10, 14, 8, 12},
+		{at(24), 12, 13, 12, 13}, // opens at the previous close
+		{at(48), 13, 15, 11, 15},
+	}
+	if got := Candles(history, 24*time.Hour); !reflect.DeepEqual(got, exp) {
+		t.Errorf("invalid candles:\ngot=%v\nexp=%v", got, exp)
+	}
+}
+
+func TestChartRender(t *testing.T) {
+	start := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	var history []PricePoint
+	for h := 0; h < 60*24; h++ {
+		history = append(history, PricePoint{start.Add(time.Duration(h) * time.Hour), 6500 + 300*math.Sin(float64(h)/50)})
+	}
+
+	for _, r := range ChartRanges {
+		for _, m := range ChartModes {
+			for _, h := range [][]PricePoint{history, nil} {
+				img := NewChart(r, m, Currencies["USD"]).Render(h)
+				if b := img.Bounds(); b.Dx() != PrinterDots || b.Dy() != 200 {
+					t.Errorf("%s/%s: invalid size: %v", r, m, b)
+				}
+
+				// Already black & white at the printer resolution: printing
+				// must not change it
+				if got := PrepareImage(img); !reflect.DeepEqual(got.Pix, img.Pix) {
+					t.Errorf("%s/%s: chart changed by printing", r, m)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Faxes travelling over MQTT are encrypted with NaCl box (Curve25519,
+// XSalsa20 and Poly1305). The backend seals each fax with its own private key
+// for the public key of the target device, so the device can both decrypt it
+// and verify that it was really sent by a trusted backend.
+
+const KeySize = 32
+
+// MaxEnvelopeAge is the maximum age of a sealed fax accepted by a device.
+// Faxes can sit in the broker for a while if the device is offline, so this
+// is generous; it mostly bounds the size of the replay cache.
+const MaxEnvelopeAge = 30 * 24 * time.Hour
+
+var (
+	ErrUntrustedSender  = errors.New("fax envelope sealed by an untrusted sender")
+	ErrUnknownRecipient = errors.New("fax envelope not sealed for this device")
+	ErrAuthFailed       = errors.New("fax envelope failed authentication")
+	ErrReplayed         = errors.New("fax envelope already received (replay?)")
+	ErrExpired          = errors.New("fax envelope is too old")
+)
+
+// Key is a Curve25519 key (either public or private).
+type Key [KeySize]byte
+
+// String returns the key encoded in base64, which is the format used in
+// configuration files and environment variables.
+func (k *Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParseKey decodes a base64-encoded key.
+func ParseKey(s string) (*Key, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	if len(buf) != KeySize {
+		return nil, fmt.Errorf("invalid key: wrong length %d", len(buf))
+	}
+	var k Key
+	copy(k[:], buf)
+	return &k, nil
+}
+
+type KeyPair struct {
+	Public  Key
+	Private Key
+}
+
+func GenerateKeyPair() (*KeyPair, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Public: *pub, Private: *priv}, nil
+}
+
+// KeyPairFromPrivate rebuilds a key pair by deriving the public key from the
+// private key.
+func KeyPairFromPrivate(priv *Key) *KeyPair {
+	kp := &KeyPair{Private: *priv}
+	pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		panic(err) // cannot happen with the basepoint
+	}
+	copy(kp.Public[:], pub)
+	return kp
+}
+
+// LoadKeyPair loads a key pair from a file containing the base64-encoded
+// private key.
+func LoadKeyPair(path string) (*KeyPair, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := ParseKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return KeyPairFromPrivate(priv), nil
+}
+
+// Save writes the private key to the specified file, readable only by the
+// current user.
+func (kp *KeyPair) Save(path string) error {
+	return WriteFileSync(path, []byte(kp.Private.String()+"\n"), 0600)
+}
+
+// LoadPublicKeys loads a list of base64-encoded public keys from a file, one
+// per line. Empty lines and lines starting with # are ignored.
+func LoadPublicKeys(path string) ([]*Key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []*Key
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := ParseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, scan.Err()
+}
+
+// SealedFax is the encrypted envelope that is published on MQTT.
+type SealedFax struct {
+	Sender    Key // public key of the sender
+	Recipient Key // public key the fax was sealed for
+	Nonce     [24]byte
+	Box       []byte
+}
+
+// sealedPayload is the plaintext contained in SealedFax.Box. The timestamp is
+// authenticated together with the payload, so that it can't be altered to
+// bypass the replay protection.
+type sealedPayload struct {
+	Timestamp time.Time
+	Payload   []byte
+}
+
+// SealFax encrypts payload for the recipient, authenticating it with the
+// sender key pair. It returns the serialized SealedFax.
+func SealFax(payload []byte, recipient *Key, sender *KeyPair) ([]byte, error) {
+	return sealFax(payload, recipient, sender, time.Now())
+}
+
+func sealFax(payload []byte, recipient *Key, sender *KeyPair, ts time.Time) ([]byte, error) {
+	plain, err := msgpack.Marshal(&sealedPayload{
+		Timestamp: ts,
+		Payload:   payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sf := SealedFax{
+		Sender:    sender.Public,
+		Recipient: *recipient,
+	}
+	if _, err := rand.Read(sf.Nonce[:]); err != nil {
+		return nil, err
+	}
+	sf.Box = box.Seal(nil, plain, &sf.Nonce, (*[KeySize]byte)(recipient), (*[KeySize]byte)(&sender.Private))
+	return msgpack.Marshal(&sf)
+}
+
+// FaxOpener decrypts and authenticates sealed faxes on the device.
+type FaxOpener struct {
+	keys    []*KeyPair
+	trusted []*Key
+
+	replayPath string
+	m          sync.Mutex
+	seen       map[[24]byte]time.Time
+}
+
+// NewFaxOpener creates a FaxOpener that accepts faxes sealed for any of keys
+// (the current device key first, followed by keys being rotated out) and
+// sent by any of the trusted public keys. If replayPath is not empty, the
+// nonces of the faxes already received are persisted there, so that replays
+// are refused even across reboots.
+func NewFaxOpener(keys []*KeyPair, trusted []*Key, replayPath string) (*FaxOpener, error) {
+	o := &FaxOpener{
+		keys:       keys,
+		trusted:    trusted,
+		replayPath: replayPath,
+		seen:       make(map[[24]byte]time.Time),
+	}
+	if replayPath != "" {
+		if err := o.loadReplayCache(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// Open decrypts a serialized SealedFax and returns its payload. It returns an
+// error if the fax cannot be authenticated, is too old, or was already
+// opened before.
+func (o *FaxOpener) Open(data []byte) ([]byte, error) {
+	var sf SealedFax
+	if err := msgpack.Unmarshal(data, &sf); err != nil {
+		return nil, fmt.Errorf("invalid fax envelope: %v", err)
+	}
+
+	var sender *Key
+	for _, k := range o.trusted {
+		if *k == sf.Sender {
+			sender = k
+			break
+		}
+	}
+	if sender == nil {
+		return nil, ErrUntrustedSender
+	}
+
+	var recipient *KeyPair
+	for _, kp := range o.keys {
+		if kp.Public == sf.Recipient {
+			recipient = kp
+			break
+		}
+	}
+	if recipient == nil {
+		return nil, ErrUnknownRecipient
+	}
+
+	plain, ok := box.Open(nil, sf.Box, &sf.Nonce, (*[KeySize]byte)(sender), (*[KeySize]byte)(&recipient.Private))
+	if !ok {
+		return nil, ErrAuthFailed
+	}
+
+	var sp sealedPayload
+	if err := msgpack.Unmarshal(plain, &sp); err != nil {
+		return nil, fmt.Errorf("invalid fax envelope payload: %v", err)
+	}
+	if time.Since(sp.Timestamp) > MaxEnvelopeAge {
+		return nil, ErrExpired
+	}
+
+	o.m.Lock()
+	defer o.m.Unlock()
+	if _, found := o.seen[sf.Nonce]; found {
+		return nil, ErrReplayed
+	}
+	o.seen[sf.Nonce] = sp.Timestamp
+	if err := o.saveReplayCache(); err != nil {
+		return nil, fmt.Errorf("cannot save replay cache: %v", err)
+	}
+	return sp.Payload, nil
+}
+
+// The replay cache is a text file with a nonce (hex) and a unix timestamp per
+// line. Entries older than MaxEnvelopeAge are dropped, as those envelopes
+// would be refused anyway.
+func (o *FaxOpener) loadReplayCache() error {
+	data, err := ioutil.ReadFile(o.replayPath)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		nonce, err := hex.DecodeString(fields[0])
+		if err != nil || len(nonce) != 24 {
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		var n [24]byte
+		copy(n[:], nonce)
+		o.seen[n] = time.Unix(ts, 0)
+	}
+	return nil
+}
+
+func (o *FaxOpener) saveReplayCache() error {
+	var buf bytes.Buffer
+	for n, ts := range o.seen {
+		if time.Since(ts) > MaxEnvelopeAge {
+			delete(o.seen, n)
+			continue
+		}
+		fmt.Fprintf(&buf, "%x %d\n", n[:], ts.Unix())
+	}
+	if o.replayPath == "" {
+		return nil
+	}
+	return WriteFileSync(o.replayPath, buf.Bytes(), 0600)
+}
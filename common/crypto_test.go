@@ -0,0 +1,166 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func mustKeyPair(t *testing.T) *KeyPair {
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kp
+}
+
+func TestSealOpenFax(t *testing.T) {
+	backend, device, other := mustKeyPair(t), mustKeyPair(t), mustKeyPair(t)
+	payload := []byte("hello, cryptofax")
+
+	sealed, err := SealFax(payload, &device.Public, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fax sealed by an unknown backend, or for another device, is refused
+	o, _ := NewFaxOpener([]*KeyPair{device}, []*Key{&other.Public}, "")
+	if _, err := o.Open(sealed); err != ErrUntrustedSender {
+		t.Errorf("untrusted sender: got %v", err)
+	}
+	// Without trusted keys, no sender is accepted
+	o, _ = NewFaxOpener([]*KeyPair{device}, nil, "")
+	if _, err := o.Open(sealed); err != ErrUntrustedSender {
+		t.Errorf("no trusted keys: got %v", err)
+	}
+	o, _ = NewFaxOpener([]*KeyPair{other}, []*Key{&backend.Public}, "")
+	if _, err := o.Open(sealed); err != ErrUnknownRecipient {
+		t.Errorf("unknown recipient: got %v", err)
+	}
+
+	o, _ = NewFaxOpener([]*KeyPair{device}, []*Key{&backend.Public}, "")
+	got, err := o.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("invalid payload: got %q, exp %q", got, payload)
+	}
+}
+
+func TestOpenTamperedFax(t *testing.T) {
+	backend, device := mustKeyPair(t), mustKeyPair(t)
+	sealed, err := SealFax([]byte("pay 1 BTC"), &device.Public, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sf SealedFax
+	if err := msgpack.Unmarshal(sealed, &sf); err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := []func(sf *SealedFax){
+		func(sf *SealedFax) { sf.Box[len(sf.Box)-1] ^= 1 },
+		func(sf *SealedFax) { sf.Box[0] ^= 1 },
+		func(sf *SealedFax) { sf.Nonce[0] ^= 1 },
+	}
+	for i, fn := range tamper {
+		sf2 := sf
+		sf2.Box = append([]byte(nil), sf.Box...)
+		fn(&sf2)
+		data, _ := msgpack.Marshal(&sf2)
+
+		o, _ := NewFaxOpener([]*KeyPair{device}, []*Key{&backend.Public}, "")
+		if _, err := o.Open(data); err != ErrAuthFailed {
+			t.Errorf("tamper %d: got %v, exp %v", i, err, ErrAuthFailed)
+		}
+	}
+
+	// A fax whose sender key is replaced with a trusted one (which did not
+	// seal it) must not authenticate either
+	forger := mustKeyPair(t)
+	forged, _ := SealFax([]byte("pay 1 BTC"), &device.Public, forger)
+	msgpack.Unmarshal(forged, &sf)
+	sf.Sender = backend.Public
+	data, _ := msgpack.Marshal(&sf)
+	o, _ := NewFaxOpener([]*KeyPair{device}, []*Key{&backend.Public}, "")
+	if _, err := o.Open(data); err != ErrAuthFailed {
+		t.Errorf("forged sender: got %v, exp %v", err, ErrAuthFailed)
+	}
+}
+
+func TestOpenReplayedFax(t *testing.T) {
+	backend, device := mustKeyPair(t), mustKeyPair(t)
+
+	dir, err := ioutil.TempDir("", "cryptofax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replay := filepath.Join(dir, "replay")
+
+	sealed, _ := SealFax([]byte("once"), &device.Public, backend)
+
+	o, err := NewFaxOpener([]*KeyPair{device}, []*Key{&backend.Public}, replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Open(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Open(sealed); err != ErrReplayed {
+		t.Errorf("replay: got %v, exp %v", err, ErrReplayed)
+	}
+
+	// Replays are refused after a restart too
+	o, err = NewFaxOpener([]*KeyPair{device}, []*Key{&backend.Public}, replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Open(sealed); err != ErrReplayed {
+		t.Errorf("replay after restart: got %v, exp %v", err, ErrReplayed)
+	}
+
+	// Faxes too old to be in the replay cache are refused as well
+	old, _ := sealFax([]byte("old"), &device.Public, backend, time.Now().Add(-MaxEnvelopeAge-time.Hour))
+	if _, err := o.Open(old); err != ErrExpired {
+		t.Errorf("old fax: got %v, exp %v", err, ErrExpired)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	backend, oldkey, newkey := mustKeyPair(t), mustKeyPair(t), mustKeyPair(t)
+
+	// Faxes sealed for the previous key still open during the rotation
+	o, _ := NewFaxOpener([]*KeyPair{newkey, oldkey}, []*Key{&backend.Public}, "")
+	for _, kp := range []*KeyPair{oldkey, newkey} {
+		sealed, _ := SealFax([]byte("rotate"), &kp.Public, backend)
+		if _, err := o.Open(sealed); err != nil {
+			t.Errorf("key %v: %v", kp.Public.String(), err)
+		}
+	}
+
+	// Keys survive a save/load roundtrip
+	dir, err := ioutil.TempDir("", "cryptofax")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "device.key")
+	if err := newkey.Save(fn); err != nil {
+		t.Fatal(err)
+	}
+	kp, err := LoadKeyPair(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *kp != *newkey {
+		t.Errorf("loaded key pair differs from saved one")
+	}
+}
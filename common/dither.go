@@ -0,0 +1,188 @@
+package common
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// MonoPalette is the palette of images ready to be printed: index 0 is white
+// (no dot), index 1 is black.
+var MonoPalette = color.Palette{color.White, color.Black}
+
+// ToGray converts an image to grayscale, compositing it over a white
+// background (so that transparent areas are not printed).
+func ToGray(img image.Image) *image.Gray {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Over)
+
+	gray := image.NewGray(rgba.Bounds())
+	draw.Draw(gray, gray.Bounds(), rgba, image.ZP, draw.Src)
+	return gray
+}
+
+// diffusionKernel describes how the quantization error of a pixel is
+// distributed to its neighbours: each row starts at the pixel being
+// processed (whose weight is ignored) and is centered on it.
+type diffusionKernel struct {
+	weights [][]float32
+	divisor float32
+}
+
+var (
+	floydSteinberg = diffusionKernel{
+		weights: [][]float32{
+			{0, 0, 7},
+			{3, 5, 1},
+		},
+		divisor: 16,
+	}
+
+	// Atkinson only diffuses 3/4 of the error, which keeps more contrast
+	// (good for screenshots and text) at the cost of blowing out highlights.
+	atkinson = diffusionKernel{
+		weights: [][]float32{
+			{0, 0, 0, 1, 1},
+			{0, 1, 1, 1, 0},
+			{0, 0, 1, 0, 0},
+		},
+		divisor: 8,
+	}
+
+	stucki = diffusionKernel{
+		weights: [][]float32{
+			{0, 0, 0, 8, 4},
+			{2, 4, 8, 4, 2},
+			{1, 2, 4, 2, 1},
+		},
+		divisor: 42,
+	}
+)
+
+// bayer8 is the 8x8 Bayer threshold matrix for ordered dithering.
+var bayer8 = [8][8]uint8{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// DitherMethod is an algorithm to convert a grayscale image to black & white.
+type DitherMethod string
+
+const (
+	DitherFloydSteinberg DitherMethod = "floyd-steinberg"
+	DitherAtkinson       DitherMethod = "atkinson"
+	DitherStucki         DitherMethod = "stucki"
+	DitherBayer          DitherMethod = "bayer"     // ordered dithering
+	DitherThreshold      DitherMethod = "threshold" // no dithering at all
+)
+
+// DitherMethods lists all the available dithering methods.
+var DitherMethods = []DitherMethod{
+	DitherFloydSteinberg,
+	DitherAtkinson,
+	DitherStucki,
+	DitherBayer,
+	DitherThreshold,
+}
+
+// ParseDitherMethod returns the dithering method with the specified name.
+func ParseDitherMethod(name string) (DitherMethod, error) {
+	for _, m := range DitherMethods {
+		if string(m) == name {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown dithering method: %q", name)
+}
+
+// Dither converts a grayscale image into a monochrome image (see MonoPalette).
+// Unknown methods fall back to Floyd-Steinberg.
+func (m DitherMethod) Dither(gray *image.Gray) *image.Paletted {
+	switch m {
+	case DitherAtkinson:
+		return errorDiffusion(gray, atkinson)
+	case DitherStucki:
+		return errorDiffusion(gray, stucki)
+	case DitherBayer:
+		return ordered(gray)
+	case DitherThreshold:
+		return threshold(gray, 128)
+	default:
+		return errorDiffusion(gray, floydSteinberg)
+	}
+}
+
+func threshold(gray *image.Gray, level uint8) *image.Paletted {
+	b := gray.Bounds()
+	out := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), MonoPalette)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if gray.GrayAt(b.Min.X+x, b.Min.Y+y).Y < level {
+				out.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return out
+}
+
+func ordered(gray *image.Gray) *image.Paletted {
+	b := gray.Bounds()
+	out := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), MonoPalette)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			// Scale the matrix to thresholds in the middle of 0-255 slices
+			level := int(bayer8[y%8][x%8])*4 + 2
+			if int(gray.GrayAt(b.Min.X+x, b.Min.Y+y).Y) < level {
+				out.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return out
+}
+
+// errorDiffusion dithers a grayscale image into a monochrome image, using the
+// specified kernel.
+func errorDiffusion(gray *image.Gray, k diffusionKernel) *image.Paletted {
+	b := gray.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Work on a float copy, so that errors can accumulate past 0-255
+	px := make([]float32, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px[y*w+x] = float32(gray.GrayAt(b.Min.X+x, b.Min.Y+y).Y)
+		}
+	}
+
+	out := image.NewPaletted(image.Rect(0, 0, w, h), MonoPalette)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			old := px[y*w+x]
+			var quant float32 = 255
+			if old < 128 {
+				quant = 0
+				out.SetColorIndex(x, y, 1)
+			}
+			qerr := (old - quant) / k.divisor
+			for dy, row := range k.weights {
+				for i, wt := range row {
+					dx := i - len(row)/2
+					if wt == 0 || x+dx < 0 || x+dx >= w || y+dy >= h {
+						continue
+					}
+					px[(y+dy)*w+x+dx] += qerr * wt
+				}
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestDitherMethods(t *testing.T) {
+	uniform := func(y uint8) *image.Gray {
+		gray := image.NewGray(image.Rect(0, 0, 64, 64))
+		draw.Draw(gray, gray.Bounds(), image.NewUniform(color.Gray{y}), image.ZP, draw.Src)
+		return gray
+	}
+
+	var tests = []struct {
+		gray     uint8
+		min, max int // expected percentage of black dots
+	}{
+		{0, 100, 100},
+		{255, 0, 0},
+		{128, 45, 55},
+		{192, 15, 30}, // Atkinson loses some of the error
+	}
+
+	for _, m := range DitherMethods {
+		for _, tc := range tests {
+			min, max := tc.min, tc.max
+			if m == DitherThreshold && tc.gray != 0 {
+				min, max = 0, 0
+			}
+
+			mono := m.Dither(uniform(tc.gray))
+			black := 0
+			for _, px := range mono.Pix {
+				black += int(px)
+			}
+			if pct := black * 100 / len(mono.Pix); pct < min || pct > max {
+				t.Errorf("%s: invalid dithering of gray %d: %d%% black dots, exp %d-%d%%", m, tc.gray, pct, min, max)
+			}
+		}
+	}
+}
+
+func TestParseDitherMethod(t *testing.T) {
+	for _, m := range DitherMethods {
+		if got, err := ParseDitherMethod(string(m)); err != nil || got != m {
+			t.Errorf("cannot parse %q: got %q, %v", m, got, err)
+		}
+	}
+	if _, err := ParseDitherMethod("unknown"); err == nil {
+		t.Errorf("unknown method was not refused")
+	}
+}
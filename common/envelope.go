@@ -0,0 +1,115 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Envelope is the self-describing message exchanged between backend and
+// devices (inside the SealedFax encryption layer). Older firmwares must be
+// able to tell when they receive something they don't understand, so the
+// envelope structure itself must never change in incompatible ways: bump
+// EnvelopeVersion and add a new content type instead.
+//
+// Version history:
+//   0: no envelope, the payload was a bare msgpack-encoded Fax
+//   1: first envelope version
+const EnvelopeVersion = 1
+
+const (
+	ContentTypeFax = "application/vnd.cryptofax.fax+msgpack"
+)
+
+type Envelope struct {
+	Version     int
+	ID          string
+	ContentType string
+	Payload     []byte
+}
+
+// UnsupportedVersionError is returned when decoding an envelope created by a
+// newer version of the software.
+type UnsupportedVersionError struct {
+	Version int
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("envelope version %d is not supported (max %d): a software update is required",
+		e.Version, EnvelopeVersion)
+}
+
+// NewMessageID returns a new random message ID.
+func NewMessageID() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// NewFaxEnvelope wraps a fax into a new envelope with a fresh message ID.
+func NewFaxEnvelope(fax *Fax) (*Envelope, error) {
+	payload, err := msgpack.Marshal(fax)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Version:     EnvelopeVersion,
+		ID:          NewMessageID(),
+		ContentType: ContentTypeFax,
+		Payload:     payload,
+	}, nil
+}
+
+func (e *Envelope) Marshal() ([]byte, error) {
+	return msgpack.Marshal(e)
+}
+
+// DecodeEnvelope decodes an envelope, accepting all the versions up to
+// EnvelopeVersion. Payloads sent by older backends (version 0) are wrapped in
+// an envelope with no ID.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	var fields map[string]interface{}
+	if err := msgpack.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+
+	if _, found := fields["Version"]; !found {
+		if _, found := fields["Sender"]; found {
+			return &Envelope{ContentType: ContentTypeFax, Payload: data}, nil
+		}
+		return nil, errors.New("invalid envelope: no version found")
+	}
+
+	// Check the version before decoding the whole structure, so that an
+	// envelope from the future is reported as such.
+	var hdr struct{ Version int }
+	if err := msgpack.Unmarshal(data, &hdr); err != nil {
+		return nil, fmt.Errorf("invalid envelope version: %v", err)
+	}
+	if hdr.Version > EnvelopeVersion || hdr.Version < 1 {
+		return nil, &UnsupportedVersionError{hdr.Version}
+	}
+
+	var env Envelope
+	if err := msgpack.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("invalid envelope (version %d): %v", hdr.Version, err)
+	}
+	return &env, nil
+}
+
+// Fax decodes the fax contained in the envelope.
+func (e *Envelope) Fax() (*Fax, error) {
+	if e.ContentType != ContentTypeFax {
+		return nil, fmt.Errorf("envelope %s: unsupported content type %q", e.ID, e.ContentType)
+	}
+	var fax Fax
+	if err := msgpack.Unmarshal(e.Payload, &fax); err != nil {
+		return nil, fmt.Errorf("envelope %s: invalid fax: %v", e.ID, err)
+	}
+	return &fax, nil
+}
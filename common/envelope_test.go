@@ -0,0 +1,78 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestEnvelopeRoundtrip(t *testing.T) {
+	fax := Fax{Sender: "Diego", Message: "ciao", Timestamp: time.Unix(1500000000, 0)}
+	env, err := NewFaxEnvelope(&fax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := env.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env2, err := DecodeEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env2.Version != EnvelopeVersion || env2.ID != env.ID || env2.ContentType != ContentTypeFax {
+		t.Errorf("invalid envelope header: %+v", env2)
+	}
+	fax2, err := env2.Fax()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fax2.Sender != fax.Sender || fax2.Message != fax.Message || !fax2.Timestamp.Equal(fax.Timestamp) {
+		t.Errorf("invalid fax: got %+v, exp %+v", fax2, fax)
+	}
+}
+
+func TestEnvelopeLegacy(t *testing.T) {
+	// Version 0: a bare Fax, as sent by older backends
+	data, _ := msgpack.Marshal(&Fax{Sender: "Diego", Message: "old"})
+	env, err := DecodeEnvelope(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Version != 0 {
+		t.Errorf("invalid version: %d", env.Version)
+	}
+	fax, err := env.Fax()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fax.Message != "old" {
+		t.Errorf("invalid message: %q", fax.Message)
+	}
+}
+
+func TestEnvelopeFutureVersion(t *testing.T) {
+	// A future envelope might change the layout of any field except Version
+	future := struct {
+		Version int
+		ID      []int
+		Payload map[string]string
+	}{EnvelopeVersion + 1, []int{1, 2}, map[string]string{"a": "b"}}
+	data, _ := msgpack.Marshal(&future)
+
+	_, err := DecodeEnvelope(data)
+	if verr, ok := err.(*UnsupportedVersionError); !ok || verr.Version != EnvelopeVersion+1 {
+		t.Errorf("expected UnsupportedVersionError, got %v", err)
+	}
+
+	if _, err := DecodeEnvelope([]byte("garbage")); err == nil {
+		t.Errorf("garbage decoded without errors")
+	}
+
+	env := &Envelope{Version: EnvelopeVersion, ContentType: "text/plain"}
+	if _, err := env.Fax(); err == nil {
+		t.Errorf("unknown content type decoded without errors")
+	}
+}
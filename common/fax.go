@@ -1,12 +1,110 @@
 package common
 
-import "time"
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"time"
+)
 
+// FaxMqttTopic is the root of all the MQTT topics used by CryptoFaxPA.
 const FaxMqttTopic = "fax"
 
+// DefaultDeviceId is the ID of a device that was not configured with one.
+const DefaultDeviceId = "client"
+
 type Fax struct {
 	Timestamp time.Time
 	Sender    string
 	Message   string
 	Picture   []byte
+
+	// Message rendered by the backend as a PNG image, to print characters
+	// that the printer font doesn't have. If present, it is printed in place
+	// of Message.
+	RenderedMessage []byte
+}
+
+// PrintFax prints a fax on p, returning an error only if the printer failed.
+func PrintFax(p Printer, fax *Fax) error {
+	var buf bytes.Buffer
+	buf.Write(Layout(
+		Paragraph{Spans: []Span{
+			{Text: "Fax from ", Mode: ModeDoubleHeight},
+			{Text: fax.Sender, Mode: ModeDoubleHeight | ModeUnderline},
+		}},
+		Paragraph{Spans: []Span{
+			{Text: fmt.Sprintf("(%v)", fax.Timestamp.Format("2006-01-02 15:04"))},
+		}},
+		Paragraph{},
+	))
+
+	// The message might have been rendered as an image by the backend
+	var images [][]byte
+	if len(fax.RenderedMessage) != 0 {
+		images = append(images, fax.RenderedMessage)
+	} else if fax.Message != "" {
+		buf.Write(FormatForPrinter(fax.Message))
+	}
+	if len(fax.Picture) != 0 {
+		images = append(images, fax.Picture)
+	}
+	for _, data := range images {
+		img, err := decodeImage(data)
+		if err != nil {
+			log.Printf("[ERROR] cannot print fax image: %v", err)
+			continue
+		}
+		buf.WriteByte('\n')
+		buf.Write(EncodeImage(img))
+	}
+
+	// The whole fax is sent as a single job, so that the printer status is
+	// checked only once. If the printer fails midway, the fax is printed
+	// again from the start (header included) when it's retried.
+	return printBytes(p, buf.Bytes(), true)
+}
+
+// PreviewFax prints a fax on a VirtualPrinter, and returns the printed paper.
+// The backend uses it to show the sender what the fax will look like.
+func PreviewFax(fax *Fax) *image.Paletted {
+	vp := NewVirtualPrinter()
+	PrintFax(vp, fax)
+	return vp.Image()
+}
+
+// FaxTopic returns the MQTT topic on which a device receives its faxes.
+func FaxTopic(device string) string {
+	return FaxMqttTopic + "/" + device
+}
+
+// FaxStatusTopic returns the MQTT topic on which a device publishes the
+// status of the faxes it receives.
+func FaxStatusTopic(device string) string {
+	return FaxMqttTopic + "/" + device + "/status"
+}
+
+// FaxStatusTopicFilter matches the status topics of all devices.
+const FaxStatusTopicFilter = FaxMqttTopic + "/+/status"
+
+type FaxStatusCode string
+
+const (
+	FaxReceived FaxStatusCode = "received"
+	FaxSpooled  FaxStatusCode = "spooled"
+	FaxPrinting FaxStatusCode = "printing"
+	FaxDelayed  FaxStatusCode = "delayed" // printer problem, will be retried
+	FaxPrinted  FaxStatusCode = "printed"
+	FaxFailed   FaxStatusCode = "failed"
+)
+
+// FaxStatus is a delivery receipt, sent by the device to the backend every
+// time a fax progresses through the printing pipeline.
+type FaxStatus struct {
+	ID        string // Envelope.ID of the fax
+	Device    string
+	Status    FaxStatusCode
+	Reason    string // only for FaxFailed
+	Timestamp time.Time
 }
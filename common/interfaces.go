@@ -1,8 +1,12 @@
 package common
 
 import (
+	"encoding/xml"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -35,7 +39,7 @@ func (i Interface) Name() string {
 	case IntfGSM:
 		return "GSM / UMTS"
 	}
-	panic("unreachable")
+	return string(i)
 }
 
 func InterfaceInspect(iif Interface) InterfaceDesc {
@@ -90,3 +94,99 @@ func InterfaceInspect(iif Interface) InterfaceDesc {
 		return desc
 	}
 }
+
+// DefaultInterface returns the interface of the default route, that is the
+// one used to connect to Internet, or an empty string if there's none.
+func DefaultInterface() Interface {
+	data, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	return parseDefaultRoute(string(data))
+}
+
+// parseDefaultRoute returns the interface of the default route with the
+// lowest metric in the routing table (as in /proc/net/route).
+func parseDefaultRoute(table string) Interface {
+	best, bestMetric := "", -1
+	for _, line := range strings.Split(table, "\n")[1:] {
+		f := strings.Fields(line)
+		if len(f) < 7 || f[1] != "00000000" {
+			continue
+		}
+		metric, err := strconv.Atoi(f[6])
+		if err == nil && (bestMetric < 0 || metric < bestMetric) {
+			best, bestMetric = f[0], metric
+		}
+	}
+	return Interface(best)
+}
+
+// SignalStrength returns the strength of the signal of a wireless interface,
+// or an empty string if unknown.
+func SignalStrength(iif Interface) string {
+	switch iif {
+	case IntfWiFi:
+		data, err := ioutil.ReadFile("/proc/net/wireless")
+		if err != nil {
+			return ""
+		}
+		return parseWirelessSignal(string(data), iif)
+	case IntfGSM:
+		return hilinkSignal()
+	}
+	return ""
+}
+
+// parseWirelessSignal returns the signal level of an interface in the
+// statistics of the wireless interfaces (as in /proc/net/wireless):
+//
+//	Inter-|sta-|   Quality        |   Discarded packets
+//	 face |tus | link level noise |  nwid  crypt   frag
+//	wlan0: 0000   70.  -40.  -256        0      0      0
+func parseWirelessSignal(stats string, iif Interface) string {
+	for _, line := range strings.Split(stats, "\n") {
+		f := strings.Fields(line)
+		if len(f) >= 4 && f[0] == string(iif)+":" {
+			return strings.TrimSuffix(f[3], ".") + " dBm"
+		}
+	}
+	return ""
+}
+
+// hilinkSignal asks the signal strength to the web interface of the GSM
+// modem (Huawei HiLink), which needs a session token.
+func hilinkSignal() string {
+	const api = "http://192.168.8.1/api/"
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	var tok struct {
+		SesInfo string
+		TokInfo string
+	}
+	resp, err := client.Get(api + "webserver/SesTokInfo")
+	if err != nil {
+		return ""
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&tok)
+	resp.Body.Close()
+	if err != nil {
+		return ""
+	}
+
+	req, _ := http.NewRequest("GET", api+"device/signal", nil)
+	req.Header.Set("Cookie", tok.SesInfo)
+	req.Header.Set("__RequestVerificationToken", tok.TokInfo)
+	resp, err = client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	var signal struct {
+		RSSI string `xml:"rssi"`
+	}
+	if xml.NewDecoder(resp.Body).Decode(&signal) != nil {
+		return ""
+	}
+	return strings.Replace(signal.RSSI, "dBm", " dBm", 1)
+}
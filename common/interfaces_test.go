@@ -0,0 +1,64 @@
+package common
+
+import "testing"
+
+func TestParseDefaultRoute(t *testing.T) {
+	const header = "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+
+	var tests = []struct {
+		table string
+		iif   Interface
+	}{
+		// Wi-Fi only
+		{header +
+			"wlan0\t00000000\t0100A8C0\t0003\t0\t0\t303\t00000000\t0\t0\t0\n" +
+			"wlan0\t0000A8C0\t00000000\t0001\t0\t0\t303\t00FFFFFF\t0\t0\t0\n",
+			IntfWiFi},
+		// Wi-Fi and GSM: the lowest metric wins, whatever the order
+		{header +
+			"eth1\t00000000\t0108A8C0\t0003\t0\t0\t204\t00000000\t0\t0\t0\n" +
+			"wlan0\t00000000\t0100A8C0\t0003\t0\t0\t303\t00000000\t0\t0\t0\n",
+			IntfGSM},
+		{header +
+			"wlan0\t00000000\t0100A8C0\t0003\t0\t0\t303\t00000000\t0\t0\t0\n" +
+			"eth0\t00000000\t0101A8C0\t0003\t0\t0\t202\t00000000\t0\t0\t0\n",
+			IntfEthernet},
+		// Only the access point, which has no default route
+		{header +
+			"ap0\t0004A8C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n",
+			""},
+		{header, ""},
+		{"", ""},
+	}
+
+	for i, tc := range tests {
+		if iif := parseDefaultRoute(tc.table); iif != tc.iif {
+			t.Errorf("%d: got %q, exp %q", i, iif, tc.iif)
+		}
+	}
+}
+
+func TestParseWirelessSignal(t *testing.T) {
+	const stats = "Inter-| sta-|   Quality        |   Discarded packets               | Missed | WE\n" +
+		" face | tus | link level noise |  nwid  crypt   frag  retry   misc | beacon | 22\n" +
+		" wlan0: 0000   70.  -40.  -256        0      0      0      0      0        0\n" +
+		"wlan1: 0000   35  -75  -256        0      0      0      0      0        0\n"
+
+	var tests = []struct {
+		iif    Interface
+		signal string
+	}{
+		{IntfWiFi, "-40 dBm"},
+		{"wlan1", "-75 dBm"},
+		{IntfAccessPoint, ""},
+	}
+
+	for _, tc := range tests {
+		if s := parseWirelessSignal(stats, tc.iif); s != tc.signal {
+			t.Errorf("%s: got %q, exp %q", tc.iif, s, tc.signal)
+		}
+	}
+	if s := parseWirelessSignal("", IntfWiFi); s != "" {
+		t.Errorf("signal without statistics: %q", s)
+	}
+}
@@ -0,0 +1,250 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PrinterDots is the printable width of the Pipsta printer.
+const PrinterDots = 384
+
+// Print mode bits, as used by the ESC ! command.
+const (
+	ModeFontB        = 0x01
+	ModeEmphasized   = 0x08
+	ModeDoubleHeight = 0x10
+	ModeDoubleWidth  = 0x20
+	ModeUnderline    = 0x80
+)
+
+// charWidth returns the width in dots of a character printed in mode: font A
+// is 12x24, font B is 9x17.
+func charWidth(mode byte) int {
+	w := 12
+	if mode&ModeFontB != 0 {
+		w = 9
+	}
+	if mode&ModeDoubleWidth != 0 {
+		w *= 2
+	}
+	return w
+}
+
+// charHeight returns the height in dots of a character printed in mode.
+func charHeight(mode byte) int {
+	h := 24
+	if mode&ModeFontB != 0 {
+		h = 17
+	}
+	if mode&ModeDoubleHeight != 0 {
+		h *= 2
+	}
+	return h
+}
+
+// Columns returns the number of characters that fit on a line when printing
+// in the specified mode (eg: 32 for font A, 16 for font A double-width, 42
+// for font B).
+func Columns(mode byte) int {
+	return PrinterDots / charWidth(mode)
+}
+
+type Align int
+
+const (
+	AlignLeft Align = iota
+	AlignCenter
+	AlignRight
+)
+
+// Span is a run of text printed in the same mode.
+type Span struct {
+	Text string
+	Mode byte
+}
+
+// Paragraph is a block of text that Layout wraps to the paper width.
+type Paragraph struct {
+	Spans []Span
+	Align Align
+
+	// Prefix is printed at the beginning of the first line (eg: a bullet),
+	// Indent at the beginning of the following ones. Both are printed in the
+	// default mode.
+	Prefix string
+	Indent string
+
+	// Preformatted text keeps all its spaces, and is broken at any character
+	// instead of on word boundaries.
+	Preformatted bool
+}
+
+// piece is a part of a word which is printed in a single mode.
+type piece struct {
+	text  string
+	mode  byte
+	width int // in dots
+}
+
+func newPiece(text string, mode byte) piece {
+	return piece{text, mode, utf8.RuneCountInString(text) * charWidth(mode)}
+}
+
+// word is a sequence of non-space characters, which can span multiple modes.
+type word struct {
+	pieces []piece
+	space  byte // mode of the space preceding the word
+}
+
+func (w *word) width() (n int) {
+	for _, p := range w.pieces {
+		n += p.width
+	}
+	return
+}
+
+func (w *word) append(r rune, mode byte) {
+	if n := len(w.pieces); n > 0 && w.pieces[n-1].mode == mode {
+		w.pieces[n-1] = newPiece(w.pieces[n-1].text+string(r), mode)
+		return
+	}
+	w.pieces = append(w.pieces, newPiece(string(r), mode))
+}
+
+// split breaks the word so that the first part fits in width dots (at least
+// one character is always kept, even if it doesn't fit).
+func (w *word) split(width int) (head, tail word) {
+	tail.space = w.space
+	for _, p := range w.pieces {
+		for _, r := range p.text {
+			cw := charWidth(p.mode)
+			if len(tail.pieces) == 0 && (head.width()+cw <= width || len(head.pieces) == 0) {
+				head.append(r, p.mode)
+			} else {
+				tail.append(r, p.mode)
+			}
+		}
+	}
+	return
+}
+
+// words splits the paragraph into words. Preformatted paragraphs are a
+// single word, spaces included.
+func (p *Paragraph) words() []word {
+	var words []word
+	var cur word
+	for _, s := range p.Spans {
+		for _, r := range s.Text {
+			if unicode.IsSpace(r) && !p.Preformatted {
+				if len(cur.pieces) > 0 {
+					words = append(words, cur)
+					cur = word{}
+				}
+				cur.space = s.Mode
+				continue
+			}
+			if r == '\t' {
+				r = ' '
+			}
+			cur.append(r, s.Mode)
+		}
+	}
+	if len(cur.pieces) > 0 {
+		words = append(words, cur)
+	}
+	return words
+}
+
+// Layout wraps the paragraphs on word boundaries to the paper width, and
+// converts them to raw bytes for the printer. Words too long to fit on a line
+// by themselves (eg: URLs) are hyphenated. Every line ends with a newline, and
+// the printer is left in the default mode.
+func Layout(paras ...Paragraph) []byte {
+	var buf bytes.Buffer
+	for i := range paras {
+		paras[i].layout(&buf)
+	}
+	return buf.Bytes()
+}
+
+func (p *Paragraph) layout(buf *bytes.Buffer) {
+	var line []piece
+	lineWidth := 0
+	prefix := p.Prefix
+
+	avail := func() int {
+		return PrinterDots - utf8.RuneCountInString(prefix)*charWidth(0)
+	}
+	flush := func() {
+		p.writeLine(buf, prefix, line, avail()-lineWidth)
+		line, lineWidth, prefix = nil, 0, p.Indent
+	}
+	add := func(w word) {
+		line = append(line, w.pieces...)
+		lineWidth += w.width()
+	}
+
+	words := p.words()
+	if len(words) == 0 {
+		p.writeLine(buf, strings.TrimRight(prefix, " "), nil, 0)
+		return
+	}
+	for _, w := range words {
+		if len(line) > 0 {
+			sp := newPiece(" ", w.space)
+			if lineWidth+sp.width+w.width() <= avail() {
+				line = append(line, sp)
+				lineWidth += sp.width
+				add(w)
+				continue
+			}
+			flush()
+		}
+
+		// Break words which don't fit on a line by themselves
+		for w.width() > avail() {
+			var head word
+			if p.Preformatted {
+				head, w = w.split(avail())
+			} else {
+				hyphen := newPiece("-", w.pieces[0].mode)
+				head, w = w.split(avail() - hyphen.width)
+				head.append('-', head.pieces[len(head.pieces)-1].mode)
+			}
+			add(head)
+			flush()
+		}
+		add(w)
+	}
+	flush()
+}
+
+func (p *Paragraph) writeLine(buf *bytes.Buffer, prefix string, line []piece, free int) {
+	buf.Write(EncodeForPrinter(prefix))
+	switch p.Align {
+	case AlignCenter:
+		buf.WriteString(strings.Repeat(" ", free/2/charWidth(0)))
+	case AlignRight:
+		buf.WriteString(strings.Repeat(" ", free/charWidth(0)))
+	}
+
+	var mode byte
+	for _, pc := range line {
+		if pc.mode != mode {
+			setMode(buf, pc.mode)
+			mode = pc.mode
+		}
+		buf.Write(EncodeForPrinter(pc.text))
+	}
+	if mode != 0 {
+		setMode(buf, 0)
+	}
+	buf.WriteByte('\n')
+}
+
+func setMode(buf *bytes.Buffer, mode byte) {
+	buf.WriteString("\x1b!")
+	buf.WriteByte(mode)
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestColumns(t *testing.T) {
+	var tests = []struct {
+		mode byte
+		cols int
+	}{
+		{0x00, 32},
+		{ModeDoubleHeight, 32},
+		{ModeDoubleHeight | ModeDoubleWidth, 16},
+		{ModeEmphasized | ModeUnderline, 32},
+		{ModeFontB, 42},
+		{ModeFontB | ModeDoubleWidth, 21},
+	}
+
+	for _, tc := range tests {
+		if got := Columns(tc.mode); got != tc.cols {
+			t.Errorf("invalid columns for mode %02x: got %d, exp %d", tc.mode, got, tc.cols)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	long := strings.Repeat("a", 40)
+	var tests = []struct {
+		name string
+		in   Paragraph
+		out  string
+	}{
+		{"empty", Paragraph{}, "\n"},
+		{"empty quote", Paragraph{Prefix: "│ "}, "\xb3\n"},
+		{"short", Paragraph{Spans: []Span{{"hello  world", 0}}}, "hello world\n"},
+		{
+			"wrap",
+			Paragraph{Spans: []Span{{"the quick brown fox jumps over the lazy dog", 0}}},
+			"the quick brown fox jumps over\nthe lazy dog\n",
+		},
+		{
+			"exact fit",
+			Paragraph{Spans: []Span{{strings.Repeat("a", 32) + " b", 0}}},
+			strings.Repeat("a", 32) + "\nb\n",
+		},
+		{
+			"hyphenate",
+			Paragraph{Spans: []Span{{"see " + long, 0}}},
+			"see\n" + strings.Repeat("a", 31) + "-\n" + strings.Repeat("a", 9) + "\n",
+		},
+		{
+			"double width",
+			Paragraph{Spans: []Span{{"Hello World Again", ModeDoubleWidth}}},
+			"\x1b! Hello World\x1b!\x00\n\x1b! Again\x1b!\x00\n",
+		},
+		{
+			"modes across lines",
+			Paragraph{Spans: []Span{{strings.Repeat("a", 30) + " ", 0}, {"bold text", ModeEmphasized}}},
+			strings.Repeat("a", 30) + "\n\x1b!\x08bold text\x1b!\x00\n",
+		},
+		{
+			"word with mixed modes",
+			Paragraph{Spans: []Span{{strings.Repeat("a", 28) + " b", 0}, {"cde", ModeEmphasized}}},
+			strings.Repeat("a", 28) + "\nb\x1b!\x08cde\x1b!\x00\n",
+		},
+		{"center", Paragraph{Spans: []Span{{"hello", 0}}, Align: AlignCenter}, strings.Repeat(" ", 13) + "hello\n"},
+		{"right", Paragraph{Spans: []Span{{"hello", 0}}, Align: AlignRight}, strings.Repeat(" ", 27) + "hello\n"},
+		{
+			"center double width",
+			Paragraph{Spans: []Span{{"hello", ModeDoubleWidth}}, Align: AlignCenter},
+			strings.Repeat(" ", 11) + "\x1b! hello\x1b!\x00\n",
+		},
+		{
+			"hanging indent",
+			Paragraph{Spans: []Span{{"one two three four five six seven", 0}}, Prefix: "  ∙ ", Indent: "    "},
+			"  \xf9 one two three four five six\n    seven\n",
+		},
+		{
+			"preformatted",
+			Paragraph{Spans: []Span{{"  a  b " + long, ModeFontB}}, Preformatted: true},
+			"\x1b!\x01  a  b " + strings.Repeat("a", 35) + "\x1b!\x00\n\x1b!\x01aaaaa\x1b!\x00\n",
+		},
+	}
+
+	for _, tc := range tests {
+		got := Layout(tc.in)
+		if !bytes.Equal(got, []byte(tc.out)) {
+			t.Errorf("%s: invalid layout:\ngot=%q\nexp=%q", tc.name, got, tc.out)
+		}
+	}
+}
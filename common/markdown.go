@@ -0,0 +1,293 @@
+package common
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	bullet    = "∙"
+	quoteChar = "│"
+)
+
+var slackEntities = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+
+// FormatForPrinter converts a message written with Slack mrkdwn (or plain
+// Markdown) into raw bytes for the printer, translating the formatting into
+// ESC/POS print modes:
+//
+//   *bold*, **bold**, __bold__   emphasized
+//   _italic_                     underlined (the printer has no italic)
+//   `code`, ```code blocks```    font B
+//   # Heading                    double height (and emphasized for level 1)
+//   - item, * item, 1. item      indented list items
+//   > quote                      quoted with a vertical bar
+//
+// Note that a single asterisk means bold, as in Slack. Links and mentions
+// are printed as their label, and Slack HTML entities are decoded. The text
+// is wrapped with Layout.
+func FormatForPrinter(s string) []byte {
+	return Layout(ParseMarkdown(s)...)
+}
+
+// ParseMarkdown converts a message written with Slack mrkdwn (or plain
+// Markdown) into paragraphs, one per line of the message. See
+// FormatForPrinter.
+func ParseMarkdown(s string) []Paragraph {
+	var paras []Paragraph
+	code := false
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+
+		if code {
+			if idx := strings.Index(line, "```"); idx >= 0 {
+				code = false
+				if idx > 0 {
+					paras = append(paras, codeParagraph(line[:idx]))
+				}
+				if line = strings.TrimSpace(line[idx+3:]); line == "" {
+					continue
+				}
+			} else {
+				paras = append(paras, codeParagraph(line))
+				continue
+			}
+		}
+
+		if strings.HasPrefix(line, "```") {
+			line = line[3:]
+			if idx := strings.Index(line, "```"); idx >= 0 {
+				paras = append(paras, codeParagraph(line[:idx]))
+			} else {
+				code = true
+				if line != "" {
+					paras = append(paras, codeParagraph(line))
+				}
+			}
+			continue
+		}
+
+		paras = append(paras, blockParagraph(line))
+	}
+	return paras
+}
+
+func codeParagraph(line string) Paragraph {
+	return Paragraph{
+		Spans:        []Span{{slackEntities.Replace(line), ModeFontB}},
+		Preformatted: true,
+	}
+}
+
+// blockParagraph parses a line outside code blocks.
+func blockParagraph(line string) Paragraph {
+	text := strings.TrimLeft(line, " \t")
+	indent := len(line) - len(text)
+
+	// Headings
+	if level := headingLevel(text); level > 0 {
+		mode := byte(ModeDoubleHeight)
+		if level == 1 {
+			mode |= ModeEmphasized
+		}
+		return Paragraph{Spans: parseInline(nil, strings.TrimSpace(text[level:]), mode)}
+	}
+
+	// Quotes (Slack escapes the > in the message text)
+	for _, q := range []string{">", "&gt;"} {
+		if text == q || strings.HasPrefix(text, q+" ") {
+			return Paragraph{
+				Spans:  parseInline(nil, strings.TrimSpace(text[len(q):]), 0),
+				Prefix: quoteChar + " ",
+				Indent: quoteChar + " ",
+			}
+		}
+	}
+
+	// List items, indented by nesting level; wrapped lines are aligned to
+	// the text of the item
+	if marker, rest := listItem(text); marker != "" {
+		prefix := strings.Repeat("  ", indent/2+1) + marker + " "
+		return Paragraph{
+			Spans:  parseInline(nil, rest, 0),
+			Prefix: prefix,
+			Indent: strings.Repeat(" ", utf8.RuneCountInString(prefix)),
+		}
+	}
+
+	// Keep the indentation of other lines
+	return Paragraph{
+		Spans:  parseInline(nil, text, 0),
+		Prefix: line[:indent],
+		Indent: line[:indent],
+	}
+}
+
+func headingLevel(text string) int {
+	level := 0
+	for level < len(text) && text[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || level == len(text) || text[level] != ' ' {
+		return 0
+	}
+	return level
+}
+
+// listItem returns the marker to print for a list item (if text is one),
+// followed by the text of the item.
+func listItem(text string) (string, string) {
+	for _, b := range []string{"-", "*", "+", "•"} {
+		if strings.HasPrefix(text, b+" ") {
+			return bullet, strings.TrimSpace(text[len(b):])
+		}
+	}
+	n := 0
+	for n < len(text) && text[n] >= '0' && text[n] <= '9' {
+		n++
+	}
+	if n > 0 && n < len(text)-1 && (text[n] == '.' || text[n] == ')') && text[n+1] == ' ' {
+		return text[:n+1], strings.TrimSpace(text[n+1:])
+	}
+	return "", ""
+}
+
+// spanDelimiters are the inline delimiters, longest first, with the print
+// mode bit they enable.
+var spanDelimiters = []struct {
+	delim string
+	mode  byte
+}{
+	{"**", ModeEmphasized},
+	{"__", ModeEmphasized},
+	{"*", ModeEmphasized},
+	{"_", ModeUnderline},
+}
+
+// appendSpan appends text to spans, merging it with the last span if they
+// have the same mode.
+func appendSpan(spans []Span, text string, mode byte) []Span {
+	if text == "" {
+		return spans
+	}
+	if n := len(spans); n > 0 && spans[n-1].Mode == mode {
+		spans[n-1].Text += text
+		return spans
+	}
+	return append(spans, Span{text, mode})
+}
+
+// parseInline parses the inline spans within text, which is printed in the
+// specified mode, and appends them to spans.
+func parseInline(spans []Span, text string, mode byte) []Span {
+	start := 0
+	flush := func(end int) {
+		spans = appendSpan(spans, slackEntities.Replace(text[start:end]), mode)
+	}
+
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '`':
+			if j := strings.IndexByte(text[i+1:], '`'); j > 0 {
+				flush(i)
+				spans = appendSpan(spans, slackEntities.Replace(text[i+1:i+1+j]), mode|ModeFontB)
+				i += j + 2
+				start = i
+				continue
+			}
+
+		case '<':
+			if j := strings.IndexByte(text[i+1:], '>'); j > 0 {
+				flush(i)
+				spans = appendSpan(spans, slackEntities.Replace(linkLabel(text[i+1:i+1+j])), mode)
+				i += j + 2
+				start = i
+				continue
+			}
+
+		case '*', '_':
+			matched := false
+			for _, sd := range spanDelimiters {
+				end := spanEnd(text, i, sd.delim)
+				if end < 0 {
+					continue
+				}
+				flush(i)
+				spans = parseInline(spans, text[i+len(sd.delim):end], mode|sd.mode)
+				i = end + len(sd.delim)
+				start = i
+				matched = true
+				break
+			}
+			if matched {
+				continue
+			}
+		}
+		i++
+	}
+	flush(len(text))
+	return spans
+}
+
+// spanEnd checks whether delim opens a span at text[i:], and returns the
+// index of the closing delimiter (or -1). Like in Slack, delimiters must be
+// at word boundaries and the span can't start or end with a space.
+func spanEnd(text string, i int, delim string) int {
+	if !strings.HasPrefix(text[i:], delim) || !isBoundary(text[:i], true) {
+		return -1
+	}
+	from := i + len(delim)
+	if from >= len(text) || text[from] == ' ' {
+		return -1
+	}
+	for j := from + 1; j+len(delim) <= len(text); j++ {
+		if !strings.HasPrefix(text[j:], delim) || text[j-1] == ' ' {
+			continue
+		}
+		if after := text[j+len(delim):]; isBoundary(after, false) {
+			// Don't stop on the first char of a longer delimiter (eg: "**")
+			if after == "" || after[0] != delim[0] {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// isBoundary returns true if the text before (or after) a delimiter is not
+// part of a word.
+func isBoundary(s string, before bool) bool {
+	if s == "" {
+		return true
+	}
+	var r rune
+	if before {
+		r, _ = utf8.DecodeLastRuneInString(s)
+	} else {
+		r, _ = utf8.DecodeRuneInString(s)
+	}
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// linkLabel returns the text to print for a Slack link or mention, that is
+// the text between angle brackets, eg: <https://example.com|example>,
+// <@U1234|diego> or <!here>.
+func linkLabel(link string) string {
+	target, label := link, ""
+	if idx := strings.IndexByte(link, '|'); idx >= 0 {
+		target, label = link[:idx], link[idx+1:]
+	}
+	switch {
+	case strings.HasPrefix(target, "@") || strings.HasPrefix(target, "#"):
+		if label != "" {
+			return target[:1] + label
+		}
+		return target
+	case strings.HasPrefix(target, "!"):
+		return "@" + target[1:]
+	case label != "":
+		return label
+	}
+	return strings.TrimPrefix(target, "mailto:")
+}
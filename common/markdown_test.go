@@ -0,0 +1,67 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFormatForPrinter(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		// plain text
+		{"prova", "prova\n"},
+		{"prova 🍷\nàè", "prova \xfe\n\x85\x8a\n"},
+
+		// inline spans
+		{"a *bold* word", "a \x1b!\x08bold\x1b!\x00 word\n"},
+		{"a **bold** word", "a \x1b!\x08bold\x1b!\x00 word\n"},
+		{"__bold__", "\x1b!\x08bold\x1b!\x00\n"},
+		{"an _italic_ word", "an \x1b!\x80italic\x1b!\x00 word\n"},
+		{"*bold _both_*", "\x1b!\x08bold \x1b!\x88both\x1b!\x00\n"},
+		{"run `ls *.go`", "run \x1b!\x01ls *.go\x1b!\x00\n"},
+
+		// not spans
+		{"snake_case_name", "snake_case_name\n"},
+		{"2 * 3 * 4", "2 * 3 * 4\n"},
+		{"*not closed", "*not closed\n"},
+		{"* not bold*", "  \xf9 not bold*\n"},
+		{"``", "``\n"},
+
+		// headings
+		{"# Title", "\x1b!\x18Title\x1b!\x00\n"},
+		{"## Sub *title*", "\x1b!\x10Sub \x1b!\x18title\x1b!\x00\n"},
+		{"#hashtag", "#hashtag\n"},
+
+		// lists
+		{"- one\n* two\n• three", "  \xf9 one\n  \xf9 two\n  \xf9 three\n"},
+		{"- one\n  - nested", "  \xf9 one\n    \xf9 nested\n"},
+		{"1. one\n2) _two_", "  1. one\n  2) \x1b!\x80two\x1b!\x00\n"},
+		{"- a long item which does not fit on a single line", "  \xf9 a long item which does not\n    fit on a single line\n"},
+		{"   indented text", "   indented text\n"},
+
+		// quotes
+		{"> quoted", "\xb3 quoted\n"},
+		{"&gt; quoted", "\xb3 quoted\n"},
+
+		// code blocks
+		{"```ls *.go```", "\x1b!\x01ls *.go\x1b!\x00\n"},
+		{"```\n*a*\n```\n*b*", "\x1b!\x01*a*\x1b!\x00\n\x1b!\x08b\x1b!\x00\n"},
+		{"```first\nlast```", "\x1b!\x01first\x1b!\x00\n\x1b!\x01last\x1b!\x00\n"},
+
+		// slack links, mentions and entities
+		{"see <https://example.com|this>", "see this\n"},
+		{"see <https://example.com>", "see https://example.com\n"},
+		{"<mailto:a@b.it|a@b.it>", "a@b.it\n"},
+		{"hi <@U1234|diego> <!here>", "hi @diego @here\n"},
+		{"a &lt;b&gt; &amp; c", "a <b> & c\n"},
+	}
+
+	for _, tc := range tests {
+		got := FormatForPrinter(tc.in)
+		if !bytes.Equal(got, []byte(tc.out)) {
+			t.Errorf("invalid formatting: src=%q got=%q exp=%q", tc.in, got, tc.out)
+		}
+	}
+}
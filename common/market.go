@@ -0,0 +1,405 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MarketData is the data of an asset printed in the blockchain report. Each
+// provider fills what it knows, and leaves the other fields to zero; the
+// network fields are only known for Bitcoin.
+type MarketData struct {
+	Price       float64 // in the quote currency
+	MarketCap   float64 // in the quote currency
+	HashRate    float64 // GH/s
+	Difficulty  float64
+	BlockHeight int64
+	LatestHash  string
+	BlockReward float64 // in the asset
+	TotalCoins  float64 // in the asset
+	Probability float64 // of mining a block with a single hash
+	NextBlock   time.Duration
+
+	// Why some of the fields are unknown, by field name
+	Errors map[string]string `json:",omitempty"`
+}
+
+func isZero(v reflect.Value) bool {
+	return v.Interface() == reflect.Zero(v.Type()).Interface()
+}
+
+func (d *MarketData) addError(field string, err string) {
+	if d.Errors == nil {
+		d.Errors = make(map[string]string)
+	}
+	if prev, found := d.Errors[field]; found {
+		err = prev + "; " + err
+	}
+	d.Errors[field] = err
+}
+
+// Empty returns true if all the fields are unknown.
+func (d *MarketData) Empty() bool {
+	v := reflect.ValueOf(d).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Name != "Errors" && !isZero(v.Field(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// merge fills the fields that are still unknown with those of o, which
+// comes from the provider called name; errors are kept only for the fields
+// that are still unknown.
+func (d *MarketData) merge(name string, o *MarketData) {
+	dv, ov := reflect.ValueOf(d).Elem(), reflect.ValueOf(o).Elem()
+	for i := 0; i < dv.NumField(); i++ {
+		field := dv.Type().Field(i).Name
+		if field == "Errors" || !isZero(dv.Field(i)) {
+			continue
+		}
+		if !isZero(ov.Field(i)) {
+			dv.Field(i).Set(ov.Field(i))
+			delete(d.Errors, field)
+		} else if err, found := o.Errors[field]; found {
+			d.addError(field, name+": "+err)
+		}
+	}
+}
+
+// PricePoint is the closing price of a day.
+type PricePoint struct {
+	Time  time.Time
+	Price float64 // in the quote currency
+}
+
+// ErrNotSupported is returned by providers for the data they don't have
+// (eg: for assets or currencies they don't know).
+var ErrNotSupported = errors.New("not supported by this provider")
+
+// MarketDataProvider is a source of data for the blockchain report. All
+// requests must give up when the context is done.
+type MarketDataProvider interface {
+	Name() string
+
+	// MarketData returns the current data of the asset, with prices in the
+	// currency c; the fields that could not be fetched are reported in
+	// MarketData.Errors. It also returns an error if nothing could be
+	// fetched.
+	MarketData(ctx context.Context, a *Asset, c *Currency) (*MarketData, error)
+
+	// PriceHistory returns the prices of the asset in the currency c during
+	// the range r, oldest first. The granularity is up to the provider:
+	// hourly or better is needed to draw candles shorter than a day.
+	PriceHistory(ctx context.Context, a *Asset, c *Currency, r ChartRange) ([]PricePoint, error)
+}
+
+// MarketProviders are queried in order: each field of the report comes from
+// the first provider that knows it. They can be configured with the
+// MARKET_PROVIDERS environment variable (see ParseMarketProviders).
+var MarketProviders = DefaultMarketProviders()
+
+func DefaultMarketProviders() []MarketDataProvider {
+	providers, err := ParseMarketProviders(os.Getenv("MARKET_PROVIDERS"))
+	if err != nil {
+		log.Printf("[ERROR] MARKET_PROVIDERS: %v", err)
+		providers, _ = ParseMarketProviders("")
+	}
+	return providers
+}
+
+// ParseMarketProviders parses a comma-separated list of providers, among
+// "coingecko", "mempool.space" and "blockchain.info". An empty list selects
+// all of them.
+func ParseMarketProviders(spec string) ([]MarketDataProvider, error) {
+	if spec == "" {
+		spec = "coingecko,mempool.space,blockchain.info"
+	}
+	var providers []MarketDataProvider
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "coingecko":
+			providers = append(providers, &CoinGecko{URL: "https://api.coingecko.com"})
+		case "mempool.space":
+			providers = append(providers, &MempoolSpace{URL: "https://mempool.space"})
+		case "blockchain.info":
+			providers = append(providers, &BlockchainInfo{URL: "https://blockchain.info"})
+		default:
+			return nil, fmt.Errorf("unknown market data provider: %q", name)
+		}
+	}
+	return providers, nil
+}
+
+// Fetched data is reused for a while: pressing the button again, or opening
+// the page in wificonf, doesn't need to query the providers again.
+const (
+	MarketDataTTL   = time.Minute
+	PriceHistoryTTL = time.Hour
+)
+
+// MarketCacheFile is where fetched data is cached; if empty, the cache is
+// kept in memory only. Set it to share the cache between processes.
+var MarketCacheFile string
+
+// marketCache holds data and history by asset and currency (see marketKey).
+type marketCache struct {
+	Data    map[string]cachedMarketData
+	History map[string]cachedPriceHistory
+}
+
+type cachedMarketData struct {
+	Data    *MarketData
+	Updated time.Time
+}
+
+type cachedPriceHistory struct {
+	History []PricePoint
+	Updated time.Time
+}
+
+func marketKey(a *Asset, c *Currency) string {
+	return a.Symbol + "/" + c.Code
+}
+
+var (
+	// Data and history of each asset are fetched at most once at a time,
+	// but different ones concurrently
+	marketFetchLocks = make(map[string]*sync.Mutex)
+
+	marketCacheLock sync.Mutex
+	marketCacheMem  marketCache
+)
+
+// marketFetchLock returns the lock to fetch what's cached under key.
+func marketFetchLock(key string) *sync.Mutex {
+	marketCacheLock.Lock()
+	defer marketCacheLock.Unlock()
+	m, found := marketFetchLocks[key]
+	if !found {
+		m = new(sync.Mutex)
+		marketFetchLocks[key] = m
+	}
+	return m
+}
+
+func loadMarketCache() marketCache {
+	marketCacheLock.Lock()
+	defer marketCacheLock.Unlock()
+	return readMarketCache()
+}
+
+// updateMarketCache changes the cache with update.
+func updateMarketCache(update func(c *marketCache)) {
+	marketCacheLock.Lock()
+	defer marketCacheLock.Unlock()
+	c := readMarketCache()
+	if c.Data == nil {
+		c.Data = make(map[string]cachedMarketData)
+	}
+	if c.History == nil {
+		c.History = make(map[string]cachedPriceHistory)
+	}
+	update(&c)
+	writeMarketCache(c)
+}
+
+func readMarketCache() marketCache {
+	if MarketCacheFile == "" {
+		return marketCacheMem
+	}
+	var c marketCache
+	if data, err := ioutil.ReadFile(MarketCacheFile); err == nil {
+		if err := json.Unmarshal(data, &c); err != nil {
+			log.Printf("[ERROR] invalid market data cache: %v", err)
+		}
+	}
+	return c
+}
+
+func writeMarketCache(c marketCache) {
+	marketCacheMem = c
+	if MarketCacheFile == "" {
+		return
+	}
+	// The file is shared: write aside and rename, so that it's never read
+	// half-written
+	tmp := fmt.Sprintf("%s.%d", MarketCacheFile, os.Getpid())
+	data, err := json.Marshal(&c)
+	if err == nil {
+		err = ioutil.WriteFile(tmp, data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, MarketCacheFile)
+	}
+	if err != nil {
+		log.Printf("[ERROR] cannot save market data cache: %v", err)
+	}
+}
+
+// GetMarketData queries all the providers in parallel for the current data
+// of an asset, unless it was fetched recently. It fails only if no provider
+// returned anything before the context is done.
+func GetMarketData(ctx context.Context, a *Asset, c *Currency) (*MarketData, error) {
+	key := marketKey(a, c)
+	m := marketFetchLock("data:" + key)
+	m.Lock()
+	defer m.Unlock()
+	if cached := loadMarketCache().Data[key]; cached.Data != nil && time.Since(cached.Updated) < MarketDataTTL {
+		return cached.Data, nil
+	}
+
+	type result struct {
+		data *MarketData
+		err  error
+	}
+	results := make([]result, len(MarketProviders))
+	var wg sync.WaitGroup
+	for i, p := range MarketProviders {
+		wg.Add(1)
+		go func(i int, p MarketDataProvider) {
+			defer wg.Done()
+			results[i].data, results[i].err = p.MarketData(ctx, a, c)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var data MarketData
+	var errs []string
+	for i, p := range MarketProviders {
+		if err := results[i].err; err == ErrNotSupported {
+			continue
+		} else if err != nil {
+			log.Printf("[ERROR] %s: %s: %v", p.Name(), key, err)
+			errs = append(errs, p.Name()+": "+err.Error())
+		}
+		if results[i].data != nil {
+			data.merge(p.Name(), results[i].data)
+		}
+	}
+	if data.Empty() {
+		return nil, fmt.Errorf("no market data available for %s (%s)", key, strings.Join(errs, "; "))
+	}
+
+	updateMarketCache(func(cache *marketCache) {
+		cache.Data[key] = cachedMarketData{&data, time.Now()}
+	})
+	return &data, nil
+}
+
+// GetPriceHistory returns the price history of an asset from the first
+// provider that has it, unless it was fetched recently.
+func GetPriceHistory(ctx context.Context, a *Asset, c *Currency, r ChartRange) ([]PricePoint, error) {
+	key := marketKey(a, c) + "/" + string(r)
+	m := marketFetchLock("history:" + key)
+	m.Lock()
+	defer m.Unlock()
+	if cached := loadMarketCache().History[key]; len(cached.History) > 0 && time.Since(cached.Updated) < PriceHistoryTTL {
+		return cached.History, nil
+	}
+
+	var errs []string
+	for _, p := range MarketProviders {
+		history, err := p.PriceHistory(ctx, a, c, r)
+		if err == nil && len(history) > 0 {
+			updateMarketCache(func(cache *marketCache) {
+				cache.History[key] = cachedPriceHistory{history, time.Now()}
+			})
+			return history, nil
+		}
+		if err == nil {
+			err = errors.New("empty price history")
+		}
+		if err != ErrNotSupported {
+			log.Printf("[ERROR] %s: %s: %v", p.Name(), key, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", p.Name(), err))
+		}
+	}
+	return nil, fmt.Errorf("no price history available for %s (%s)", key, strings.Join(errs, "; "))
+}
+
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+func httpGetJSON(ctx context.Context, url string, v interface{}) error {
+	body, err := httpGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	return parseJSON(url, body, v)
+}
+
+func parseJSON(url string, body []byte, v interface{}) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	return nil
+}
+
+// marketFetcher runs the requests of a provider in parallel. Each request
+// fills some fields of the data; if it fails, the error is reported for
+// those fields.
+type marketFetcher struct {
+	ctx  context.Context
+	wg   sync.WaitGroup
+	m    sync.Mutex
+	data MarketData
+}
+
+// get fetches url, and calls parse with the body to fill fields.
+func (f *marketFetcher) get(url string, parse func(body []byte) error, fields ...string) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		body, err := httpGet(f.ctx, url)
+		if err == nil {
+			err = parse(body)
+		}
+		if err != nil {
+			f.m.Lock()
+			for _, field := range fields {
+				f.data.addError(field, err.Error())
+			}
+			f.m.Unlock()
+		}
+	}()
+}
+
+// wait waits for all the requests, and fails if none succeeded.
+func (f *marketFetcher) wait() (*MarketData, error) {
+	f.wg.Wait()
+	if f.data.Empty() {
+		var errs []string
+		for field, err := range f.data.Errors {
+			errs = append(errs, field+": "+err)
+		}
+		sort.Strings(errs)
+		return &f.data, errors.New(strings.Join(errs, "; "))
+	}
+	return &f.data, nil
+}
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CoinGecko provides prices and market capitalization of all assets.
+type CoinGecko struct {
+	URL string
+}
+
+func (p *CoinGecko) Name() string { return "coingecko" }
+
+func (p *CoinGecko) MarketData(ctx context.Context, a *Asset, c *Currency) (*MarketData, error) {
+	f := marketFetcher{ctx: ctx}
+	vs := strings.ToLower(c.Code)
+	url := fmt.Sprintf("%s/api/v3/simple/price?ids=%s&vs_currencies=%s&include_market_cap=true", p.URL, a.CoinGecko, vs)
+	f.get(url, func(body []byte) error {
+		var res map[string]map[string]float64
+		if err := parseJSON(url, body, &res); err != nil {
+			return err
+		}
+		coin, found := res[a.CoinGecko]
+		if !found {
+			return fmt.Errorf("no %s price", a.Name)
+		}
+		f.data.Price, f.data.MarketCap = coin[vs], coin[vs+"_market_cap"]
+		return nil
+	}, "Price", "MarketCap")
+	return f.wait()
+}
+
+func (p *CoinGecko) PriceHistory(ctx context.Context, a *Asset, c *Currency, r ChartRange) ([]PricePoint, error) {
+	var res struct {
+		Prices [][2]float64 // unix time in milliseconds, price
+	}
+	// The granularity is automatic: 5 minutes for 1 day, hourly up to 90
+	// days, daily above
+	url := fmt.Sprintf("%s/api/v3/coins/%s/market_chart?vs_currency=%s&days=%d", p.URL, a.CoinGecko, strings.ToLower(c.Code), r.Days())
+	if err := httpGetJSON(ctx, url, &res); err != nil {
+		return nil, err
+	}
+	var history []PricePoint
+	for _, v := range res.Prices {
+		history = append(history, PricePoint{time.Unix(0, int64(v[0])*int64(time.Millisecond)).UTC(), v[1]})
+	}
+	return history, nil
+}
+
+// MempoolSpace provides the price and the state of the Bitcoin network (and
+// nothing about other assets).
+type MempoolSpace struct {
+	URL string
+}
+
+func (p *MempoolSpace) Name() string { return "mempool.space" }
+
+func (p *MempoolSpace) MarketData(ctx context.Context, a *Asset, c *Currency) (*MarketData, error) {
+	if a.Symbol != "BTC" {
+		return nil, ErrNotSupported
+	}
+	f := marketFetcher{ctx: ctx}
+
+	// Prices are available in a few currencies only: for the others, the
+	// price is just not known (which is not an error)
+	url := p.URL + "/api/v1/prices"
+	f.get(url, func(body []byte) error {
+		var prices map[string]float64
+		if err := parseJSON(url, body, &prices); err != nil {
+			return err
+		}
+		f.data.Price = prices[c.Code]
+		return nil
+	}, "Price")
+
+	f.get(p.URL+"/api/blocks/tip/height", func(body []byte) (err error) {
+		f.data.BlockHeight, err = strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+		return
+	}, "BlockHeight")
+	f.get(p.URL+"/api/blocks/tip/hash", func(body []byte) error {
+		f.data.LatestHash = strings.TrimSpace(string(body))
+		return nil
+	}, "LatestHash")
+
+	miningURL := p.URL + "/api/v1/mining/hashrate/3d"
+	f.get(miningURL, func(body []byte) error {
+		var mining struct {
+			CurrentHashrate   float64 // H/s
+			CurrentDifficulty float64
+		}
+		if err := parseJSON(miningURL, body, &mining); err != nil {
+			return err
+		}
+		f.data.HashRate = mining.CurrentHashrate / 1e9
+		f.data.Difficulty = mining.CurrentDifficulty
+		return nil
+	}, "HashRate", "Difficulty")
+
+	return f.wait()
+}
+
+func (p *MempoolSpace) PriceHistory(ctx context.Context, a *Asset, c *Currency, r ChartRange) ([]PricePoint, error) {
+	return nil, ErrNotSupported
+}
+
+// BlockchainInfo provides both market and network data of Bitcoin, through
+// the simple query API of blockchain.info (one value per request). Only the
+// price is available in currencies other than USD.
+type BlockchainInfo struct {
+	URL string
+}
+
+func (p *BlockchainInfo) Name() string { return "blockchain.info" }
+
+func (p *BlockchainInfo) MarketData(ctx context.Context, a *Asset, c *Currency) (*MarketData, error) {
+	if a.Symbol != "BTC" {
+		return nil, ErrNotSupported
+	}
+	f := marketFetcher{ctx: ctx}
+	query := func(q string, field string, set func(v float64)) {
+		f.get(p.URL+"/q/"+q, func(body []byte) error {
+			v, err := strconv.ParseFloat(strings.TrimSpace(string(body)), 64)
+			if err != nil {
+				return errors.New(q + ": " + err.Error())
+			}
+			set(v)
+			return nil
+		}, field)
+	}
+
+	if c.Code == "USD" {
+		query("24hrprice", "Price", func(v float64) { f.data.Price = v })
+		query("marketcap", "MarketCap", func(v float64) { f.data.MarketCap = v })
+	} else {
+		url := p.URL + "/ticker"
+		f.get(url, func(body []byte) error {
+			var ticker map[string]struct{ Last float64 }
+			if err := parseJSON(url, body, &ticker); err != nil {
+				return err
+			}
+			f.data.Price = ticker[c.Code].Last
+			return nil
+		}, "Price")
+	}
+	query("hashrate", "HashRate", func(v float64) { f.data.HashRate = v })
+	query("getdifficulty", "Difficulty", func(v float64) { f.data.Difficulty = v })
+	query("getblockcount", "BlockHeight", func(v float64) { f.data.BlockHeight = int64(v) })
+	query("bcperblock", "BlockReward", func(v float64) { f.data.BlockReward = v })
+	query("totalbc", "TotalCoins", func(v float64) { f.data.TotalCoins = v / 1e8 }) // satoshis
+	query("probability", "Probability", func(v float64) { f.data.Probability = v })
+	query("eta", "NextBlock", func(v float64) { f.data.NextBlock = time.Duration(v * float64(time.Second)) })
+	f.get(p.URL+"/q/latesthash", func(body []byte) error {
+		f.data.LatestHash = strings.TrimSpace(string(body))
+		return nil
+	}, "LatestHash")
+
+	return f.wait()
+}
+
+func (p *BlockchainInfo) PriceHistory(ctx context.Context, a *Asset, c *Currency, r ChartRange) ([]PricePoint, error) {
+	// Prices are daily, which is too coarse for a single day
+	if a.Symbol != "BTC" || c.Code != "USD" || r == ChartRange24h {
+		return nil, ErrNotSupported
+	}
+	var res struct {
+		Values []struct {
+			X int64   // unix time
+			Y float64 // price
+		}
+	}
+	url := fmt.Sprintf("%s/charts/market-price?timespan=%ddays&format=json", p.URL, r.Days())
+	if err := httpGetJSON(ctx, url, &res); err != nil {
+		return nil, err
+	}
+	var history []PricePoint
+	for _, v := range res.Values {
+		history = append(history, PricePoint{time.Unix(v.X, 0).UTC(), v.Y})
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Time.Before(history[j].Time) })
+	return history, nil
+}
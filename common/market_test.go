@@ -0,0 +1,336 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubMarketServer serves canned answers for the provider APIs; paths not
+// listed return 404, like an API that went away.
+func stubMarketServer(answers map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, found := answers[r.URL.RequestURI()]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+// withMarketProviders also empties the cache, so that the providers are
+// actually queried.
+func withMarketProviders(providers ...MarketDataProvider) func() {
+	old := MarketProviders
+	MarketProviders = providers
+	marketCacheMem = marketCache{}
+	return func() { MarketProviders = old }
+}
+
+func TestMarketDataFallback(t *testing.T) {
+	gecko := stubMarketServer(map[string]string{
+		"/api/v3/simple/price?ids=bitcoin&vs_currencies=usd&include_market_cap=true": `{"bitcoin":{"usd":6612.51,"usd_market_cap":114000000000}}`,
+	})
+	defer gecko.Close()
+	mempool := stubMarketServer(map[string]string{
+		"/api/blocks/tip/height": "544142",
+		"/api/blocks/tip/hash":   "00000000000000000012",
+	})
+	defer mempool.Close()
+	bcinfo := stubMarketServer(map[string]string{
+		"/q/24hrprice":     "6000.1",
+		"/q/getblockcount": "544000",
+		"/q/bcperblock":    "12.5",
+		"/q/totalbc":       "1730000000000000",
+		"/q/eta":           "93.5",
+	})
+	defer bcinfo.Close()
+
+	defer withMarketProviders(&CoinGecko{URL: gecko.URL}, &MempoolSpace{URL: mempool.URL}, &BlockchainInfo{URL: bcinfo.URL})()
+	data, err := GetMarketData(context.Background(), Assets["BTC"], Currencies["USD"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Errors["HashRate"]; !strings.Contains(err, "mempool.space: ") || !strings.Contains(err, "blockchain.info: ") {
+		t.Errorf("invalid hash rate error: %q", err)
+	}
+	if _, found := data.Errors["Price"]; found {
+		t.Errorf("error reported for a known field: %v", data.Errors)
+	}
+	got := *data
+	got.Errors = nil
+	exp := MarketData{
+		Price:       6612.51,
+		MarketCap:   114000000000,
+		BlockHeight: 544142,
+		LatestHash:  "00000000000000000012",
+		BlockReward: 12.5,
+		TotalCoins:  17300000,
+		NextBlock:   93500 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("invalid market data:\ngot=%+v\nexp=%+v", got, exp)
+	}
+
+	infos, err := GetBlockchainNerdInfos(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []BlockchainNerdInfo{
+		{Name: "Current BTC price (USD)", Value: "$6,612.51"},
+		{Name: "Global hash rate (GigaHash)", Value: "n/a"},
+		{Name: "Total coins (BTC)", Value: "17300000.00000000 BTC"},
+		{Name: "ETA until next block", Value: "1m34s"},
+	} {
+		found := false
+		for _, info := range infos {
+			found = found || (info.Name == exp.Name && info.Value == exp.Value && (info.Error != "") == (exp.Value == "n/a"))
+		}
+		if !found {
+			t.Errorf("nerd info not found: %+v", exp)
+		}
+	}
+
+	// No provider at all
+	defer withMarketProviders(&MempoolSpace{URL: gecko.URL})()
+	if _, err := GetMarketData(context.Background(), Assets["BTC"], Currencies["USD"]); err == nil {
+		t.Errorf("no error without market data")
+	}
+}
+
+func TestPriceHistory(t *testing.T) {
+	bcinfo := stubMarketServer(map[string]string{
+		"/charts/market-price?timespan=30days&format=json": `{"values":[{"x":1538438400,"y":6600.5},{"x":1538352000,"y":6500}]}`,
+	})
+	defer bcinfo.Close()
+	gecko := stubMarketServer(nil)
+	defer gecko.Close()
+
+	defer withMarketProviders(&CoinGecko{URL: gecko.URL}, &MempoolSpace{URL: gecko.URL}, &BlockchainInfo{URL: bcinfo.URL})()
+	history, err := GetPriceHistory(context.Background(), Assets["BTC"], Currencies["USD"], ChartRange30d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []PricePoint{
+		{time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC), 6500},
+		{time.Date(2018, 10, 2, 0, 0, 0, 0, time.UTC), 6600.5},
+	}
+	if len(history) != len(exp) || history[0] != exp[0] || history[1] != exp[1] {
+		t.Errorf("invalid history: %v", history)
+	}
+}
+
+func TestMarketDataTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	gecko := stubMarketServer(map[string]string{
+		"/api/v3/simple/price?ids=bitcoin&vs_currencies=usd&include_market_cap=true": `{"bitcoin":{"usd":6612.51,"usd_market_cap":114000000000}}`,
+	})
+	defer gecko.Close()
+
+	defer withMarketProviders(&CoinGecko{URL: gecko.URL}, &BlockchainInfo{URL: slow.URL})()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	data, err := GetMarketData(ctx, Assets["BTC"], Currencies["USD"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("deadline not respected: %v", time.Since(start))
+	}
+	if data.Price != 6612.51 {
+		t.Errorf("invalid price: %v", data.Price)
+	}
+	if err := data.Errors["LatestHash"]; !strings.HasPrefix(err, "blockchain.info: ") {
+		t.Errorf("invalid latest hash error: %q", err)
+	}
+}
+
+func TestMarketDataCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "market")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	MarketCacheFile = dir + "/market.json"
+	defer func() { MarketCacheFile = "" }()
+
+	hits := 0
+	gecko := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(`{"bitcoin":{"usd":6612.51}}`))
+	}))
+	defer gecko.Close()
+
+	defer withMarketProviders(&CoinGecko{URL: gecko.URL})()
+	for i := 0; i < 3; i++ {
+		data, err := GetMarketData(context.Background(), Assets["BTC"], Currencies["USD"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Price != 6612.51 {
+			t.Errorf("invalid price: %v", data.Price)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("data fetched %d times", hits)
+	}
+
+	// Another process reads the cache from the file
+	marketCacheMem = marketCache{}
+	if _, err := GetMarketData(context.Background(), Assets["BTC"], Currencies["USD"]); err != nil || hits != 1 {
+		t.Errorf("cache file not used: %v, %d hits", err, hits)
+	}
+
+	// Expired
+	updateMarketCache(func(c *marketCache) {
+		cached := c.Data["BTC/USD"]
+		cached.Updated = time.Now().Add(-MarketDataTTL)
+		c.Data["BTC/USD"] = cached
+	})
+	if _, err := GetMarketData(context.Background(), Assets["BTC"], Currencies["USD"]); err != nil || hits != 2 {
+		t.Errorf("expired cache used: %v, %d hits", err, hits)
+	}
+}
+
+func TestMarketAssets(t *testing.T) {
+	gecko := stubMarketServer(map[string]string{
+		"/api/v3/simple/price?ids=bitcoin&vs_currencies=eur&include_market_cap=true":  `{"bitcoin":{"eur":5710.2,"eur_market_cap":98765432109.8}}`,
+		"/api/v3/simple/price?ids=ethereum&vs_currencies=eur&include_market_cap=true": `{"ethereum":{"eur":1190.25}}`,
+	})
+	defer gecko.Close()
+	mempool := stubMarketServer(map[string]string{
+		"/api/v1/prices":         `{"USD":6612,"EUR":5700}`,
+		"/api/blocks/tip/height": "544142",
+	})
+	defer mempool.Close()
+
+	defer withMarketProviders(&CoinGecko{URL: gecko.URL}, &MempoolSpace{URL: mempool.URL})()
+	oldAssets, oldCurrencies := MarketAssets, MarketCurrencies
+	defer func() { MarketAssets, MarketCurrencies = oldAssets, oldCurrencies }()
+	MarketAssets, _ = ParseAssets("btc, ETH")
+	MarketCurrencies, _ = ParseCurrencies("EUR")
+
+	infos, err := GetBlockchainNerdInfos(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []BlockchainNerdInfo{
+		{Name: "Current BTC price (EUR)", Value: "EUR 5.710,20"},
+		{Name: "BTC market cap (EUR)", Value: "EUR 98.765.432.110"},
+		{Name: "Current block height", Value: "544142"},
+		{Name: "Current ETH price (EUR)", Value: "EUR 1.190,25"},
+	}
+	var got []BlockchainNerdInfo
+	for _, info := range infos {
+		// Only the values that mempool.space failed to fetch are expected
+		if info.Value != "n/a" {
+			got = append(got, info)
+		} else if info.Name == "ETA until next block" || strings.Contains(info.Name, "ETH") {
+			t.Errorf("unexpected info: %+v", info)
+		}
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("invalid infos:\ngot=%+v\nexp=%+v", got, exp)
+	}
+
+	if _, err := ParseCurrencies("EUR,XYZ"); err == nil {
+		t.Errorf("unknown currency accepted")
+	}
+}
+
+func TestCurrencyFormat(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		v    float64
+		exp  string
+	}{
+		{"USD", 6612.514, "$6,612.51"},
+		{"EUR", 6612.5, "EUR 6.612,50"},
+		{"CHF", 1234567.891, "CHF 1'234'567.89"},
+		{"JPY", 712345.6, "¥712,346"},
+	} {
+		if got := Currencies[tc.code].Format(tc.v); got != tc.exp {
+			t.Errorf("%s: got %q, exp %q", tc.code, got, tc.exp)
+		}
+	}
+}
+
+func TestBlockchainSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/blockchain.json"
+
+	if _, err := LoadBlockchainSnapshot(path); !os.IsNotExist(err) {
+		t.Errorf("invalid error without snapshot: %v", err)
+	}
+	snap := &BlockchainSnapshot{
+		Time:  time.Date(2018, 10, 1, 10, 30, 0, 0, time.UTC),
+		Infos: []BlockchainNerdInfo{{Name: "Current BTC price (USD)", Value: "$6,612.51"}},
+		Graphs: []PriceGraph{{
+			Title:   "BITCOIN LIVE EXCHANGE (USD)",
+			History: []PricePoint{{time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC), 6500}},
+			PNG:     []byte("\x89PNG"),
+		}},
+	}
+	if err := snap.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadBlockchainSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, snap) {
+		t.Errorf("invalid snapshot:\ngot=%+v\nexp=%+v", got, snap)
+	}
+
+	// Concurrent saves don't mix up, nor leave temporary files around
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := snap.Save(path); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, err := LoadBlockchainSnapshot(path); err != nil || !reflect.DeepEqual(got, snap) {
+		t.Errorf("invalid snapshot after concurrent saves: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("temporary files left: %d files", len(files))
+	}
+
+	// Snapshots with missing data are not complete
+	oldAssets := MarketAssets
+	defer func() { MarketAssets = oldAssets }()
+	MarketAssets, _ = ParseAssets("BTC")
+	if !snap.Complete() {
+		t.Errorf("complete snapshot is not complete")
+	}
+	snap.Infos = append(snap.Infos, BlockchainNerdInfo{Name: "Global hash rate (GigaHash)", Value: "n/a", Error: "timeout"})
+	if snap.Complete() {
+		t.Errorf("snapshot with unknown values is complete")
+	}
+	snap.Infos = snap.Infos[:1]
+	MarketAssets, _ = ParseAssets("BTC,ETH")
+	if snap.Complete() {
+		t.Errorf("snapshot with missing graphs is complete")
+	}
+}
@@ -1,32 +1,225 @@
 package common
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-func createClientOptions(clientId string, uri *url.URL) *mqtt.ClientOptions {
+// MqttConfig describes how to connect to the MQTT broker.
+type MqttConfig struct {
+	// URL of the broker, with the credentials. The scheme selects the
+	// transport: tcp://, ssl:// (or tls://), ws:// or wss://. mqtt:// and
+	// mqtts:// (used by CloudMQTT) are the same as tcp:// and ssl://.
+	URL string
+
+	// PEM bundle of the CAs trusted for the broker certificate; if empty,
+	// the system CAs are used.
+	CAFile string
+
+	// Pins of the broker certificate: base64 SHA-256 of the public key
+	// (SubjectPublicKeyInfo) of any certificate in the verified chain. If
+	// set, the chain must contain one of them; if there's no CAFile and the
+	// system CAs don't trust the broker (eg: self-signed), the pin of the
+	// broker certificate itself replaces the verification of the chain.
+	Pins []string
+
+	// Client certificate and key (PEM), to authenticate the device.
+	CertFile string
+	KeyFile  string
+
+	// Store of the in-flight messages; if nil, they're kept in memory
+	Store mqtt.Store
+
+	// Message published by the server when the connection is lost
+	WillTopic    string
+	WillPayload  []byte
+	WillRetained bool
+
+	// Called after each connection (including automatic reconnections),
+	// and when the connection is lost.
+	OnConnect        mqtt.OnConnectHandler
+	OnConnectionLost mqtt.ConnectionLostHandler
+}
+
+var mqttSchemes = map[string]string{
+	"":      "tcp",
+	"mqtt":  "tcp",
+	"tcp":   "tcp",
+	"mqtts": "ssl",
+	"ssl":   "ssl",
+	"tls":   "ssl",
+	"ws":    "ws",
+	"wss":   "wss",
+}
+
+// PublicKeyPin returns the pin of a certificate, in the format of
+// MqttConfig.Pins.
+func PublicKeyPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// tlsConfig returns the TLS configuration for the broker (whose certificate
+// must be valid for host), or nil if TLS needs no special configuration.
+func (cfg *MqttConfig) tlsConfig(host string) (*tls.Config, error) {
+	if cfg.CAFile == "" && len(cfg.Pins) == 0 && cfg.CertFile == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{}
+
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.CAFile)
+		}
+	}
+
+	if len(cfg.Pins) != 0 {
+		pins := make(map[string]bool)
+		for _, p := range cfg.Pins {
+			pins[p] = true
+		}
+		pinned := func(chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if pins[PublicKeyPin(cert)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("broker certificate does not match the pinned keys")
+		}
+
+		if cfg.CAFile != "" {
+			// The chain is verified as usual, then checked against the pins
+			tc.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+				return pinned(chains)
+			}
+		} else {
+			// Without a CA, the broker might be self-signed, so the chain is
+			// verified here: if the system CAs don't trust it, the pins are
+			// all we have, and only the certificate of the broker itself can
+			// match them.
+			tc.InsecureSkipVerify = true
+			tc.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+				if len(raw) == 0 {
+					return errors.New("no broker certificate")
+				}
+				certs := make([]*x509.Certificate, len(raw))
+				for i, der := range raw {
+					cert, err := x509.ParseCertificate(der)
+					if err != nil {
+						return err
+					}
+					certs[i] = cert
+				}
+				leaf := certs[0]
+
+				opts := x509.VerifyOptions{DNSName: host, Intermediates: x509.NewCertPool()}
+				for _, cert := range certs[1:] {
+					opts.Intermediates.AddCert(cert)
+				}
+				if chains, err := leaf.Verify(opts); err == nil {
+					return pinned(chains)
+				}
+
+				if err := pinned([][]*x509.Certificate{{leaf}}); err != nil {
+					return err
+				}
+				if err := leaf.VerifyHostname(host); err != nil {
+					return err
+				}
+				if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+					return errors.New("broker certificate expired or not yet valid")
+				}
+				return nil
+			}
+		}
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+func createClientOptions(clientId string, cfg *MqttConfig) (*mqtt.ClientOptions, error) {
+	uri, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	scheme, found := mqttSchemes[uri.Scheme]
+	if !found {
+		return nil, fmt.Errorf("unsupported MQTT scheme: %q", uri.Scheme)
+	}
+	tc, err := cfg.tlsConfig(uri.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	// Credentials are sent in the CONNECT packet, not in the URL
+	broker := *uri
+	broker.Scheme, broker.User = scheme, nil
+
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s", uri.Host))
+	opts.AddBroker(broker.String())
 	opts.SetUsername(uri.User.Username())
 	password, _ := uri.User.Password()
 	opts.SetPassword(password)
+	if tc != nil {
+		opts.SetTLSConfig(tc)
+	}
 	opts.SetClientID(clientId)
 	opts.SetCleanSession(false)
-	return opts
+	if cfg.Store != nil {
+		opts.SetStore(cfg.Store)
+	}
+	if cfg.WillTopic != "" {
+		opts.SetBinaryWill(cfg.WillTopic, cfg.WillPayload, 1, cfg.WillRetained)
+	}
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(5 * time.Minute)
+	if cfg.OnConnect != nil {
+		opts.SetOnConnectHandler(cfg.OnConnect)
+	}
+	if cfg.OnConnectionLost != nil {
+		opts.SetConnectionLostHandler(cfg.OnConnectionLost)
+	}
+	return opts, nil
 }
 
-func NewMqttClient(clientId string, uris string) (mqtt.Client, error) {
-	uri, err := url.Parse(uris)
+// CreateMqttClient creates a client for the broker, without connecting it.
+func CreateMqttClient(clientId string, cfg *MqttConfig) (mqtt.Client, error) {
+	opts, err := createClientOptions(clientId, cfg)
 	if err != nil {
 		return nil, err
 	}
+	return mqtt.NewClient(opts), nil
+}
 
-	opts := createClientOptions(clientId, uri)
-	client := mqtt.NewClient(opts)
+// NewMqttClient creates a client and connects it to the broker.
+func NewMqttClient(clientId string, cfg *MqttConfig) (mqtt.Client, error) {
+	client, err := CreateMqttClient(clientId, cfg)
+	if err != nil {
+		return nil, err
+	}
 	token := client.Connect()
 	if !token.WaitTimeout(3 * time.Second) {
 		return nil, fmt.Errorf("timeout while connecting to CloudMQTT")
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// SyncFileStore is a mqtt.Store that keeps the in-flight messages in a
+// directory, so that a QoS 2 handshake can be completed after a power
+// cycle. Unlike mqtt.FileStore, each message is synced to disk before Put
+// returns (otherwise a reboot could lose it anyway), and errors are logged
+// instead of panicking.
+type SyncFileStore struct {
+	dir string
+	m   sync.RWMutex
+}
+
+const mqttStoreExt = ".msg"
+
+func NewSyncFileStore(dir string) *SyncFileStore {
+	return &SyncFileStore{dir: dir}
+}
+
+func (s *SyncFileStore) path(key string) string {
+	return filepath.Join(s.dir, key+mqttStoreExt)
+}
+
+func (s *SyncFileStore) Open() {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		log.Printf("[ERROR] cannot open MQTT store: %v", err)
+	}
+}
+
+func (s *SyncFileStore) Close() {}
+
+func (s *SyncFileStore) Put(key string, msg packets.ControlPacket) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var buf bytes.Buffer
+	if err := msg.Write(&buf); err != nil {
+		log.Printf("[ERROR] cannot store MQTT message %s: %v", key, err)
+		return
+	}
+	// Write aside and rename, so that a message is never half-written
+	tmp := filepath.Join(s.dir, key+".tmp")
+	err := WriteFileSync(tmp, buf.Bytes(), 0600)
+	if err == nil {
+		err = os.Rename(tmp, s.path(key))
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		log.Printf("[ERROR] cannot store MQTT message %s: %v", key, err)
+	}
+}
+
+func (s *SyncFileStore) Get(key string) packets.ControlPacket {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	msg, err := packets.ReadPacket(f)
+	if err != nil {
+		log.Printf("[ERROR] corrupted MQTT message %s: %v", key, err)
+		return nil
+	}
+	return msg
+}
+
+// All returns the keys of all the messages, in the order they were stored.
+func (s *SyncFileStore) All() []string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.all()
+}
+
+func (s *SyncFileStore) all() []string {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("[ERROR] cannot read MQTT store: %v", err)
+		return nil
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	var keys []string
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), mqttStoreExt) {
+			keys = append(keys, strings.TrimSuffix(fi.Name(), mqttStoreExt))
+		}
+	}
+	return keys
+}
+
+func (s *SyncFileStore) Del(key string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] cannot delete MQTT message %s: %v", key, err)
+	}
+}
+
+func (s *SyncFileStore) Reset() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, key := range s.all() {
+		os.Remove(s.path(key))
+	}
+}
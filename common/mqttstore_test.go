@@ -0,0 +1,52 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func TestSyncFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewSyncFileStore(dir + "/mqtt")
+	s.Open()
+	for i, key := range []string{"i.2", "o.1"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos, pub.MessageID = 2, uint16(i+1)
+		pub.TopicName, pub.Payload = "fax/client", []byte("fax")
+		s.Put(key, pub)
+		time.Sleep(10 * time.Millisecond) // keys are sorted by time
+	}
+
+	// A new store on the same directory, as after a reboot
+	s = NewSyncFileStore(dir + "/mqtt")
+	s.Open()
+	if keys := s.All(); !reflect.DeepEqual(keys, []string{"i.2", "o.1"}) {
+		t.Errorf("invalid keys: %v", keys)
+	}
+	pub, ok := s.Get("o.1").(*packets.PublishPacket)
+	if !ok || pub.MessageID != 2 || string(pub.Payload) != "fax" {
+		t.Errorf("invalid message: %v", pub)
+	}
+	if s.Get("o.3") != nil {
+		t.Errorf("missing message found")
+	}
+
+	s.Del("i.2")
+	if keys := s.All(); !reflect.DeepEqual(keys, []string{"o.1"}) {
+		t.Errorf("invalid keys after delete: %v", keys)
+	}
+	s.Reset()
+	if keys := s.All(); len(keys) != 0 {
+		t.Errorf("invalid keys after reset: %v", keys)
+	}
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// PresenceTopic returns the MQTT topic on which a device publishes its
+// presence. Presence messages are retained, so whoever subscribes gets the
+// last known state right away.
+func PresenceTopic(device string) string {
+	return FaxMqttTopic + "/" + device + "/presence"
+}
+
+// PresenceTopicFilter matches the presence topics of all devices.
+const PresenceTopicFilter = FaxMqttTopic + "/+/presence"
+
+// PresenceDevice returns the device of a presence topic, or an empty string
+// if the topic is not a presence topic.
+func PresenceDevice(topic string) string {
+	f := strings.Split(topic, "/")
+	if len(f) != 3 || f[0] != FaxMqttTopic || f[1] == "" || f[2] != "presence" {
+		return ""
+	}
+	return f[1]
+}
+
+// PresenceInterval is how often an online device publishes its presence.
+const PresenceInterval = 5 * time.Minute
+
+// DevicePresence is published by the devices when they connect and every
+// PresenceInterval; the MQTT server publishes it with Online=false (as last
+// will) when a device disconnects.
+type DevicePresence struct {
+	Device    string
+	Online    bool
+	Version   string        // firmware version
+	Uptime    time.Duration // of the system
+	Spool     int           // faxes waiting to be printed
+	Network   string        // interface used to connect (eg: "Wi-Fi")
+	Signal    string        // strength of the signal, if wireless (eg: "-67 dBm")
+	Timestamp time.Time
+}
+
+// FirmwareVersionFile is written by swupdate.sh with the timestamp of the
+// installed release.
+const FirmwareVersionFile = "/var/cache/firmware.last_updated"
+
+// FirmwareVersion returns the installed firmware version, or an empty
+// string if unknown (eg: development builds).
+func FirmwareVersion() string {
+	version, _ := ioutil.ReadFile(FirmwareVersionFile)
+	return strings.TrimSpace(string(version))
+}
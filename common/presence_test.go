@@ -0,0 +1,24 @@
+package common
+
+import "testing"
+
+func TestPresenceDevice(t *testing.T) {
+	var tests = []struct {
+		topic  string
+		device string
+	}{
+		{PresenceTopic("office"), "office"},
+		{PresenceTopic(DefaultDeviceId), DefaultDeviceId},
+		{"fax/office/status", ""},
+		{"fax/office", ""},
+		{"fax//presence", ""},
+		{"other/office/presence", ""},
+		{"fax/office/presence/more", ""},
+	}
+
+	for _, tc := range tests {
+		if d := PresenceDevice(tc.topic); d != tc.device {
+			t.Errorf("%s: got %q, exp %q", tc.topic, d, tc.device)
+		}
+	}
+}
@@ -4,23 +4,124 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"image/color"
-	"image/png"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/nfnt/resize"
 	"golang.org/x/text/encoding/charmap"
 )
 
 const printer_path = "/dev/usb/lp0"
 
+// Printer receives the raw (cp437-encoded) bytes to be printed, including
+// ESC/POS commands.
+type Printer interface {
+	io.Writer
+
+	// Connected returns true if the printer is attached.
+	Connected() bool
+
+	// Status returns the real-time status of the printer. An error means
+	// that the status could not be read.
+	Status() (PrinterStatus, error)
+}
+
+// DefaultPrinter is the printer used by PrintBytes and all the other print
+// functions.
+var DefaultPrinter Printer = &USBPrinter{Path: printer_path}
+
+// OpenPrinter returns the printer described by spec: either the path of the
+// USB printer device, or "file:" followed by the path of a file to which all
+// the bytes are appended (useful for debugging).
+func OpenPrinter(spec string) Printer {
+	if strings.HasPrefix(spec, "file:") {
+		return &FilePrinter{Path: strings.TrimPrefix(spec, "file:")}
+	}
+	return &USBPrinter{Path: spec}
+}
+
+// USBPrinter is the Pipsta printer, through the usblp device. It can be
+// used by multiple goroutines (eg: the LED is set while a fax is printing).
+type USBPrinter struct {
+	Path string
+
+	// serializes the accesses to the device: writes are split in chunks, and
+	// the status commands expect their answers
+	m sync.Mutex
+
+	// consecutive status queries that the printer didn't answer: after
+	// realTimeMaxTimeouts, the real-time status commands are not sent (and
+	// waited for) anymore, until the printer is plugged in again
+	timeouts int
+}
+
+func (p *USBPrinter) Connected() bool {
+	_, err := os.Stat(p.Path)
+	return !os.IsNotExist(err)
+}
+
+func (p *USBPrinter) Write(buf []byte) (n int, err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	f, err := os.OpenFile(p.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// write in chunks in order not to saturate the usblp buffer
+	for offset := 0; offset < len(buf); offset += 1024 {
+		end := min(offset+1024, len(buf))
+		nw, err := f.Write(buf[offset:end])
+		n += nw
+		if err != nil {
+			return n, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return n, nil
+}
+
+// FilePrinter appends everything that is printed to a file.
+type FilePrinter struct {
+	Path string
+}
+
+func (p *FilePrinter) Connected() bool {
+	return true
+}
+
+func (p *FilePrinter) Status() (PrinterStatus, error) {
+	return PrinterStatus{}, nil
+}
+
+func (p *FilePrinter) Write(buf []byte) (int, error) {
+	f, err := os.OpenFile(p.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.Write(buf)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return n, err
+}
+
 func PrinterIsConnected() bool {
-    _, err := os.Stat(printer_path)
-    return !os.IsNotExist(err)
+	return DefaultPrinter.Connected()
 }
 
 // Convert a Unicode string into the encoding understood by the printer.
-// TODO: we could handle Markdown here as well
+// See FormatForPrinter to also handle Markdown formatting.
 func EncodeForPrinter(s string) (out []byte) {
 	cmap := charmap.CodePage437
 	for _, r := range s {
@@ -33,6 +134,18 @@ func EncodeForPrinter(s string) (out []byte) {
 	return
 }
 
+// CanEncodeForPrinter returns true if all the characters in the string are
+// available in the printer encoding.
+func CanEncodeForPrinter(s string) bool {
+	cmap := charmap.CodePage437
+	for _, r := range s {
+		if _, ok := cmap.EncodeRune(r); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func min(x, y int) int {
 	if x < y {
 		return x
@@ -40,72 +153,54 @@ func min(x, y int) int {
 	return y
 }
 
-// Print raw (cp437-encoded) bytes to the printer
-func PrintBytes(buf []byte, feed_past_cutter bool) {
-	f, err := os.Create(printer_path)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	defer f.Close()
+// Print raw (cp437-encoded) bytes to the printer. The printer status is
+// checked first, so that nothing is sent to a printer which can't print it;
+// problems of the printer are reported as *PrinterError.
+func PrintBytes(buf []byte, feed_past_cutter bool) error {
+	return printBytes(DefaultPrinter, buf, feed_past_cutter)
+}
 
-	// write in chunks in order not to saturate the usblp buffer
-	for offset := 0; offset < len(buf); offset += 1024 {
-		end := min(offset+1024, len(buf))
-		f.Write(buf[offset:end])
-		time.Sleep(100 * time.Millisecond)
+func printBytes(p Printer, buf []byte, feed_past_cutter bool) error {
+	if st, err := p.Status(); err != nil {
+		log.Printf("[INFO] cannot read printer status: %v", err)
+	} else if err := st.Err(); err != nil {
+		return err
 	}
 
-	f.Write([]byte("\n"))
+	data := make([]byte, 0, len(buf)+5)
+	data = append(data, buf...)
+	data = append(data, '\n')
 	if feed_past_cutter {
-		f.Write([]byte("\n\n\n\n"))
+		data = append(data, "\n\n\n\n"...)
+	}
+
+	if _, err := p.Write(data); err != nil {
+		return &PrinterError{err}
 	}
+	return nil
 }
 
 // Print a Unicode string to the printer, using EncodeForPrinter to convert it
 // to raw bytes.
-func PrintString(s string, feed_past_cutter bool) {
-	PrintBytes(EncodeForPrinter(s), feed_past_cutter)
+func PrintString(s string, feed_past_cutter bool) error {
+	return PrintBytes(EncodeForPrinter(s), feed_past_cutter)
 }
 
-func PrintImage(pngimg []byte, feed_past_cutter bool) {
-	var DOTS_PER_LINE = 384
-
-	imgobj, err := png.Decode(bytes.NewReader(pngimg))
-	if err != nil {
-		fmt.Println(err)
-	}
-	b := imgobj.Bounds()
-	imgWidth := b.Max.X
-	imgHeight := b.Max.Y
-	fmt.Printf("decoded image: %vx%v\n", imgWidth, imgHeight)
-
-	if imgWidth > DOTS_PER_LINE || imgWidth%8 > 0 {
-		// TODO: resize image if it's too large or its
-		// width is not a multiple of 8
-		fmt.Println("image too large; skipping")
-		return
-	}
-
-	/*
-	   // save image to a file for debugging purposes
-	   f, err := os.Create("img.png")
-	   if err != nil {
-	       panic(err)
-	   }
-	   defer f.Close()
-	   png.Encode(f, imgobj)
-	*/
-
-	// turn the decoded PNG image into an array of black/white dots
-	var bits = make([]bool, imgWidth*imgHeight)
-	bounds := imgobj.Bounds()
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			// black = 1, white = 0
-			bits[y*imgWidth+x] = color.GrayModel.Convert(imgobj.At(x, y)).(color.Gray).Y < 224
-		}
+// PrepareImage scales an image down to the width of the paper (if it's
+// larger), and dithers it to black & white.
+func PrepareImage(img image.Image) *image.Paletted {
+	if img.Bounds().Dx() > PrinterDots {
+		img = resize.Resize(PrinterDots, 0, img, resize.Lanczos3)
 	}
+	return DitherFloydSteinberg.Dither(ToGray(img))
+}
+
+// EncodeImage converts an image into the raw bytes that print it as bit
+// image graphics. The image is prepared with PrepareImage, and padded with
+// white dots to the whole width of the paper.
+func EncodeImage(img image.Image) []byte {
+	mono := PrepareImage(img)
+	w, h := mono.Bounds().Dx(), mono.Bounds().Dy()
 
 	var buf bytes.Buffer
 	buf.WriteString("\x1b!\x03") // set font mode 3
@@ -113,51 +208,63 @@ func PrintImage(pngimg []byte, feed_past_cutter bool) {
 	// prepare the command used for printing a single line
 	cmd := make([]byte, 5)
 	copy(cmd[0:], "\x1b*\x08") // select SDL graphics
-	binary.LittleEndian.PutUint16(cmd[3:], uint16(DOTS_PER_LINE/8))
+	binary.LittleEndian.PutUint16(cmd[3:], uint16(PrinterDots/8))
 
 	// iterate over lines
-	for i := 0; i < imgHeight; i++ {
+	for y := 0; y < h; y++ {
 		buf.Write(cmd)
 
-		// calculate the bits range for this line
-		start := imgWidth * i
-		end := imgWidth * (i + 1)
-
-		// iterate over the bits to be printed
-		for k := start; k < end; k += 8 {
-			// since we can't append individual bits to buf,
-			// make a byte
-			var b byte
-			for j := 0; j < 8; j++ {
-				// reversed endianness!
-				if bits[k+(7-j)] {
-					b |= 1 << uint16(j)
-				} else {
-					b |= 0 << uint16(j)
-				}
+		// pack dots into bytes, MSB first (black = 1, white = 0)
+		line := make([]byte, PrinterDots/8)
+		for x := 0; x < w; x++ {
+			if mono.ColorIndexAt(x, y) == 1 {
+				line[x/8] |= 0x80 >> uint(x%8)
 			}
-
-			buf.WriteByte(b)
 		}
-
-		// if the image to be printed is smaller than our printer width,
-		// pad it with white dots
-		buf.Write(make([]byte, (DOTS_PER_LINE-imgWidth)/8))
+		buf.Write(line)
 		buf.WriteByte('\n')
 	}
+	return buf.Bytes()
+}
+
+// PrintImage prints an image in any of the supported formats (PNG, JPEG, GIF).
+func PrintImage(data []byte, feed_past_cutter bool) error {
+	return printImage(DefaultPrinter, data, feed_past_cutter)
+}
+
+func printImage(p Printer, data []byte, feed_past_cutter bool) error {
+	img, err := decodeImage(data)
+	if err != nil {
+		return err
+	}
+	return printBytes(p, EncodeImage(img), feed_past_cutter)
+}
 
-	PrintBytes(buf.Bytes(), feed_past_cutter)
+func decodeImage(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode image: %v", err)
+	}
+	return img, nil
+}
+
+// setLED sends a LED command, regardless of the printer status (the LED is
+// used to signal problems, too).
+func setLED(cmd string) {
+	if _, err := DefaultPrinter.Write([]byte(cmd + "\n")); err != nil {
+		log.Printf("[ERROR] cannot set printer LED: %v", err)
+	}
 }
 
 func StartBlinkingGreen() {
-    PrintString("\x1bX\x2d\x01", false)
+	setLED("\x1bX\x2d\x01")
 }
 
 func StartBlinkingRed() {
-    PrintString("\x1bX\x2d\x02", false)
+	setLED("\x1bX\x2d\x02")
 }
 
 // turns to green
 func StopBlinking() {
-    PrintString("\x1bX\x2d\x00", false)
+	setLED("\x1bX\x2d\x00")
 }
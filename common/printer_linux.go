@@ -0,0 +1,36 @@
+package common
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/lp.h
+const (
+	lpGetStatusIoctl = 0x060b
+	lpPaperOut       = 0x20
+	lpSelected       = 0x10
+)
+
+// lpGetStatus reads the port status of the usblp device. It opens the device
+// on its own, as File.Fd switches the file to blocking mode.
+func lpGetStatus(path string, st *PrinterStatus) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var status int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), lpGetStatusIoctl, uintptr(unsafe.Pointer(&status)))
+	if errno != 0 {
+		if errno == syscall.ENOTTY {
+			return nil // not a printer device (eg: a pipe used for testing)
+		}
+		return errno
+	}
+	st.PaperOut = status&lpPaperOut != 0
+	st.Offline = status&lpSelected == 0
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+// lpGetStatus is only available on Linux: on other systems (used for
+// development) the port status is assumed to be fine.
+func lpGetStatus(path string, st *PrinterStatus) error {
+	return nil
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	ErrPaperOut  = errors.New("paper out")
+	ErrCoverOpen = errors.New("cover open")
+	ErrOverheat  = errors.New("print head overheated")
+	ErrOffline   = errors.New("printer offline")
+)
+
+// PrinterError is an error of the printer itself (as opposed to an error in
+// what is being printed): printing can be retried once the problem is fixed.
+type PrinterError struct {
+	Err error
+}
+
+func (e *PrinterError) Error() string {
+	return "printer error: " + e.Err.Error()
+}
+
+// IsPrinterError returns true if err is a *PrinterError.
+func IsPrinterError(err error) bool {
+	_, ok := err.(*PrinterError)
+	return ok
+}
+
+// PrinterStatus is the real-time status reported by the printer.
+type PrinterStatus struct {
+	PaperOut  bool
+	CoverOpen bool
+	Overheat  bool
+	Offline   bool
+}
+
+// Err returns the PrinterError that prevents printing, if any.
+func (s PrinterStatus) Err() error {
+	switch {
+	case s.PaperOut:
+		return &PrinterError{ErrPaperOut}
+	case s.CoverOpen:
+		return &PrinterError{ErrCoverOpen}
+	case s.Overheat:
+		return &PrinterError{ErrOverheat}
+	case s.Offline:
+		return &PrinterError{ErrOffline}
+	}
+	return nil
+}
+
+// realTimeMaxTimeouts is how many status queries in a row the printer must
+// leave unanswered, before deciding that it doesn't support them.
+const realTimeMaxTimeouts = 3
+
+// Status queries the printer. The port status of the usblp driver tells
+// whether there's paper; the other conditions are read with the ESC/POS
+// real-time status command (DLE EOT), if the printer answers it: a printer
+// that repeatedly doesn't answer is not asked again.
+func (p *USBPrinter) Status() (PrinterStatus, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var st PrinterStatus
+	if err := lpGetStatus(p.Path, &st); err != nil {
+		p.timeouts = 0 // unplugged, it might be another printer next time
+		return st, err
+	}
+	if p.timeouts >= realTimeMaxTimeouts {
+		return st, nil
+	}
+
+	f, err := os.OpenFile(p.Path, os.O_RDWR, 0)
+	if err != nil {
+		return st, err
+	}
+	defer f.Close()
+
+	// Reads block forever if the printer doesn't answer, so they need a
+	// deadline; without one, just rely on the port status.
+	if f.SetReadDeadline(time.Now().Add(500*time.Millisecond)) != nil {
+		return st, nil
+	}
+	for _, n := range []byte{2, 3, 4} {
+		if _, err := f.Write([]byte{0x10, 0x04, n}); err != nil {
+			return st, err
+		}
+		var resp [1]byte
+		if _, err := f.Read(resp[:]); err != nil {
+			// The printer might just be busy, or still waking up
+			if p.timeouts++; p.timeouts == realTimeMaxTimeouts {
+				log.Printf("[INFO] printer doesn't answer real-time status commands: %v", err)
+			}
+			return st, nil
+		}
+		p.timeouts = 0
+		parseRealTimeStatus(n, resp[0], &st)
+	}
+	return st, nil
+}
+
+// parseRealTimeStatus decodes the answer to DLE EOT n.
+func parseRealTimeStatus(n byte, b byte, st *PrinterStatus) {
+	if b&0x93 != 0x12 {
+		return // not a status byte: fixed bits are wrong
+	}
+	switch n {
+	case 2: // offline cause
+		st.CoverOpen = st.CoverOpen || b&0x04 != 0
+		st.PaperOut = st.PaperOut || b&0x20 != 0
+	case 3: // error cause
+		st.Overheat = st.Overheat || b&0x40 != 0 // auto-recoverable error
+	case 4: // paper roll sensor
+		st.PaperOut = st.PaperOut || b&0x60 != 0
+	}
+}
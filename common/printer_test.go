@@ -2,6 +2,8 @@ package common
 
 import (
 	"bytes"
+	"image"
+	"image/color"
 	"testing"
 )
 
@@ -22,3 +24,102 @@ func TestEncodeForPrinter(t *testing.T) {
 		}
 	}
 }
+
+func TestCanEncodeForPrinter(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out bool
+	}{
+		{"prova", true},
+		{"àèìòù", true},
+		{"prova 🍷", false},
+		{"Ελλάδα", false},
+		{"Привет", false},
+	}
+
+	for _, tc := range tests {
+		if got := CanEncodeForPrinter(tc.in); got != tc.out {
+			t.Errorf("invalid result for %q: got %v, exp %v", tc.in, got, tc.out)
+		}
+	}
+}
+
+func TestEncodeImage(t *testing.T) {
+	line := func(dots ...byte) string {
+		l := make([]byte, PrinterDots/8)
+		copy(l, dots)
+		return "\x1b*\x08\x30\x00" + string(l) + "\n"
+	}
+
+	// 10x2 black image: not a multiple of 8, padded to the paper width
+	black := image.NewGray(image.Rect(0, 0, 10, 2))
+	got := EncodeImage(black)
+	exp := "\x1b!\x03" + line(0xff, 0xc0) + line(0xff, 0xc0)
+	if string(got) != exp {
+		t.Errorf("invalid black image:\ngot=%q\nexp=%q", got, exp)
+	}
+
+	// Transparent pixels are white, and the origin doesn't matter
+	img := image.NewNRGBA(image.Rect(5, 5, 21, 6))
+	img.Set(5, 5, color.Black)
+	img.Set(20, 5, color.Black)
+	got = EncodeImage(img)
+	exp = "\x1b!\x03" + line(0x80, 0x01)
+	if string(got) != exp {
+		t.Errorf("invalid transparent image:\ngot=%q\nexp=%q", got, exp)
+	}
+
+	// Large images are scaled to the paper width
+	large := image.NewGray(image.Rect(0, 0, 2*PrinterDots, 20))
+	mono := PrepareImage(large)
+	if b := mono.Bounds(); b.Dx() != PrinterDots || b.Dy() != 10 {
+		t.Errorf("invalid scaled image size: %v", b)
+	}
+}
+
+func TestPrintImageInvalid(t *testing.T) {
+	if err := PrintImage([]byte("not an image"), false); err == nil {
+		t.Errorf("invalid image was not refused")
+	}
+}
+
+func TestPrintBytesStatus(t *testing.T) {
+	vp := NewVirtualPrinter()
+	defer func(p Printer) { DefaultPrinter = p }(DefaultPrinter)
+	DefaultPrinter = vp
+
+	vp.SetStatus(PrinterStatus{PaperOut: true})
+	if err := PrintString("lost", false); !IsPrinterError(err) || err.(*PrinterError).Err != ErrPaperOut {
+		t.Errorf("invalid error with paper out: %v", err)
+	}
+	if h := vp.Image().Bounds().Dy(); h != 0 {
+		t.Errorf("printed with paper out: height %d", h)
+	}
+
+	vp.SetStatus(PrinterStatus{})
+	if err := PrintString("ok", false); err != nil {
+		t.Errorf("cannot print: %v", err)
+	}
+}
+
+func TestParseRealTimeStatus(t *testing.T) {
+	var tests = []struct {
+		n, b byte
+		exp  PrinterStatus
+	}{
+		{2, 0x12, PrinterStatus{}},
+		{2, 0x16, PrinterStatus{CoverOpen: true}},
+		{2, 0x32, PrinterStatus{PaperOut: true}},
+		{3, 0x52, PrinterStatus{Overheat: true}},
+		{4, 0x72, PrinterStatus{PaperOut: true}},
+		{4, 0xff, PrinterStatus{}}, // not a status byte
+	}
+
+	for _, tc := range tests {
+		var st PrinterStatus
+		parseRealTimeStatus(tc.n, tc.b, &st)
+		if st != tc.exp {
+			t.Errorf("invalid status for DLE EOT %d = %02x: got %+v, exp %+v", tc.n, tc.b, st, tc.exp)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SeenIDs is a persistent record of the last message IDs received, used to
+// never print the same fax twice. MQTT delivers QoS 2 messages once per
+// session, but duplicates can still arrive across broker restarts or when
+// the backend sends the same fax again.
+// The record is bounded: once full, the oldest IDs are forgotten.
+type SeenIDs struct {
+	path string
+	size int
+
+	m   sync.Mutex
+	ids []string // in order of arrival
+	set map[string]bool
+}
+
+// OpenSeenIDs loads the record of seen IDs from path (if it exists), keeping
+// at most size IDs.
+func OpenSeenIDs(path string, size int) (*SeenIDs, error) {
+	s := &SeenIDs{path: path, size: size, set: make(map[string]bool)}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, id := range strings.Fields(string(data)) {
+		s.add(id)
+	}
+	return s, nil
+}
+
+func (s *SeenIDs) add(id string) {
+	if s.set[id] {
+		return
+	}
+	s.ids = append(s.ids, id)
+	s.set[id] = true
+	for len(s.ids) > s.size {
+		delete(s.set, s.ids[0])
+		s.ids = s.ids[1:]
+	}
+}
+
+// Seen returns true if id was already added.
+func (s *SeenIDs) Seen(id string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.set[id]
+}
+
+// Add records id as seen, and saves the record to disk.
+func (s *SeenIDs) Add(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.add(id)
+
+	var buf bytes.Buffer
+	for _, id := range s.ids {
+		buf.WriteString(id)
+		buf.WriteByte('\n')
+	}
+	return WriteFileSync(s.path, buf.Bytes(), 0600)
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeenIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "seen")
+
+	s, err := OpenSeenIDs(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c", "b", "d"} {
+		if err := s.Add(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The record survives a restart, and only the last IDs are kept
+	s, err = OpenSeenIDs(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, exp := range map[string]bool{"a": false, "b": true, "c": true, "d": true, "e": false} {
+		if got := s.Seen(id); got != exp {
+			t.Errorf("invalid seen for %q: got %v, exp %v", id, got, exp)
+		}
+	}
+}
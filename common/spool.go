@@ -0,0 +1,297 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spool is a crash-safe queue of faxes on disk. Each fax is a file that moves
+// between subdirectories according to its state:
+//
+//   pending/   waiting to be printed (possibly after a failed attempt)
+//   printing/  being printed right now
+//   done/      printed; kept for a while for debugging
+//   failed/    dead letters: faxes that could not be printed
+//
+// State changes are atomic renames within the spool directory, so after a
+// crash each fax is in exactly one state. The number of attempts and the time
+// of the next retry are encoded in the file name, so that they survive as
+// well.
+type Spool struct {
+	Dir string
+
+	MaxAttempts int           // after this many failures (not of the printer), the fax is a dead letter
+	MinBackoff  time.Duration // delay before the first retry; doubled at each attempt
+	MaxBackoff  time.Duration
+	KeepDone    time.Duration // how long printed faxes are kept in done/
+}
+
+const (
+	SpoolPending  = "pending"
+	SpoolPrinting = "printing"
+	SpoolDone     = "done"
+	SpoolFailed   = "failed"
+
+	spoolTmp = "tmp"
+)
+
+// SpoolEntry is a fax in the spool.
+type SpoolEntry struct {
+	Name     string    // unique, sorts in order of arrival
+	Attempts int       // failed attempts so far
+	RetryAt  time.Time // don't try again before this time
+	Data     []byte
+
+	spool *Spool
+	path  string // current path, which changes with the state
+}
+
+// OpenSpool opens the spool in the specified directory, creating the state
+// subdirectories if needed.
+func OpenSpool(dir string) (*Spool, error) {
+	s := &Spool{
+		Dir:         dir,
+		MaxAttempts: 50,
+		MinBackoff:  30 * time.Second,
+		MaxBackoff:  time.Hour,
+		KeepDone:    7 * 24 * time.Hour,
+	}
+	for _, sub := range []string{SpoolPending, SpoolPrinting, SpoolDone, SpoolFailed, spoolTmp} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0777); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (e *SpoolEntry) filename() string {
+	return fmt.Sprintf("%s.%d.%d", e.Name, e.Attempts, e.RetryAt.Unix())
+}
+
+// parseSpoolEntry parses the name of a file in the spool. Files without
+// attempts and retry time (eg: written by an older version of the client)
+// are new faxes.
+func (s *Spool) parseSpoolEntry(state, fn string) *SpoolEntry {
+	e := &SpoolEntry{Name: fn, RetryAt: time.Unix(0, 0), spool: s, path: filepath.Join(s.Dir, state, fn)}
+	f := strings.Split(fn, ".")
+	if len(f) != 3 {
+		return e
+	}
+	attempts, err1 := strconv.Atoi(f[1])
+	retry, err2 := strconv.ParseInt(f[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return e
+	}
+	e.Name, e.Attempts, e.RetryAt = f[0], attempts, time.Unix(retry, 0)
+	return e
+}
+
+// list returns the entries in the specified state, in order of arrival.
+func (s *Spool) list(state string) ([]*SpoolEntry, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.Dir, state))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*SpoolEntry
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".err") {
+			continue
+		}
+		entries = append(entries, s.parseSpoolEntry(state, fi.Name()))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// move atomically changes the state of an entry, and renames it after its
+// (possibly updated) attempts and retry time.
+func (e *SpoolEntry) move(state string) error {
+	path := filepath.Join(e.spool.Dir, state, e.filename())
+	if err := os.Rename(e.path, path); err != nil {
+		return err
+	}
+	e.path = path
+	return syncDir(filepath.Join(e.spool.Dir, state))
+}
+
+// syncDir makes sure that the changes to a directory are on disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// Add writes a new fax to the spool, in the pending state. The message ID (if
+// any) is part of the name, to tell which fax is which.
+func (s *Spool) Add(id string, data []byte) (*SpoolEntry, error) {
+	name := fmt.Sprintf("%016x", time.Now().UnixNano())
+	if id != "" {
+		name += "-" + id
+	}
+	e := &SpoolEntry{
+		Name:    name,
+		RetryAt: time.Unix(0, 0),
+		Data:    data,
+		spool:   s,
+	}
+	e.path = filepath.Join(s.Dir, spoolTmp, e.filename())
+
+	// Write it aside first, so that a half-written fax is never pending
+	if err := WriteFileSync(e.path, data, 0666); err != nil {
+		os.Remove(e.path)
+		return nil, err
+	}
+	if err := e.move(SpoolPending); err != nil {
+		os.Remove(e.path)
+		return nil, err
+	}
+	return e, nil
+}
+
+// Recover brings the spool back into a consistent state at boot: faxes that
+// were being printed when the process stopped are pending again (so they
+// might be printed twice, which is better than never), half-written files
+// are deleted, as well as old printed faxes. Faxes left in the spool
+// directory by older versions of the client become pending.
+// It returns the number of pending faxes.
+func (s *Spool) Recover() (int, error) {
+	printing, err := s.list(SpoolPrinting)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range printing {
+		log.Printf("[INFO] spool: fax %s was interrupted while printing", e.Name)
+		if err := e.move(SpoolPending); err != nil {
+			return 0, err
+		}
+	}
+
+	legacy, err := s.list(".")
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range legacy {
+		if err := e.move(SpoolPending); err != nil {
+			return 0, err
+		}
+	}
+
+	tmp, err := s.list(spoolTmp)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range tmp {
+		os.Remove(e.path)
+	}
+
+	if done, err := s.list(SpoolDone); err == nil {
+		for _, e := range done {
+			if fi, err := os.Stat(e.path); err == nil && time.Since(fi.ModTime()) > s.KeepDone {
+				os.Remove(e.path)
+			}
+		}
+	}
+
+	pending, err := s.list(SpoolPending)
+	return len(pending), err
+}
+
+// Pending returns the number of pending faxes, and the earliest time at which
+// one of them can be printed.
+func (s *Spool) Pending() (int, time.Time, error) {
+	pending, err := s.list(SpoolPending)
+	if err != nil || len(pending) == 0 {
+		return 0, time.Time{}, err
+	}
+	next := pending[0].RetryAt
+	for _, e := range pending[1:] {
+		if e.RetryAt.Before(next) {
+			next = e.RetryAt
+		}
+	}
+	return len(pending), next, nil
+}
+
+// Next moves the oldest pending fax that can be printed now to the printing
+// state, and returns it; it returns nil if there is none.
+// The entry must then be marked as Done, Retry or Fail.
+func (s *Spool) Next() (*SpoolEntry, error) {
+	pending, err := s.list(SpoolPending)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, e := range pending {
+		if e.RetryAt.After(now) {
+			continue
+		}
+		if err := e.move(SpoolPrinting); err != nil {
+			return nil, err
+		}
+		if e.Data, err = ioutil.ReadFile(e.path); err != nil {
+			e.Fail(err)
+			return nil, err
+		}
+		return e, nil
+	}
+	return nil, nil
+}
+
+// Done marks the fax as printed.
+func (e *SpoolEntry) Done() error {
+	if err := e.move(SpoolDone); err != nil {
+		return err
+	}
+	// Use the modification time to track when it was printed
+	now := time.Now()
+	return os.Chtimes(e.path, now, now)
+}
+
+// Retry puts the fax back in the pending state after a failed attempt, to be
+// retried after a backoff. If the fax already failed too many times, it
+// becomes a dead letter: Retry returns true if it will be retried.
+//
+// Problems of the printer (see IsPrinterError) are not the fault of the fax,
+// and can last long (eg: no paper over the weekend): they are not counted as
+// attempts, and the fax is retried after the minimum backoff until the
+// printer is fixed.
+func (e *SpoolEntry) Retry(reason error) (bool, error) {
+	if IsPrinterError(reason) {
+		e.RetryAt = time.Now().Add(e.spool.MinBackoff)
+		return true, e.move(SpoolPending)
+	}
+
+	e.Attempts++
+	if e.spool.MaxAttempts > 0 && e.Attempts >= e.spool.MaxAttempts {
+		return false, e.Fail(reason)
+	}
+
+	backoff := e.spool.MinBackoff
+	for i := 1; i < e.Attempts && backoff < e.spool.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > e.spool.MaxBackoff {
+		backoff = e.spool.MaxBackoff
+	}
+	e.RetryAt = time.Now().Add(backoff)
+	return true, e.move(SpoolPending)
+}
+
+// Fail moves the fax to the dead letters, together with a .err file that
+// explains why it failed.
+func (e *SpoolEntry) Fail(reason error) error {
+	if err := e.move(SpoolFailed); err != nil {
+		return err
+	}
+	return WriteFileSync(e.path+".err", []byte(reason.Error()+"\n"), 0666)
+}
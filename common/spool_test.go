@@ -0,0 +1,172 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempSpool(t *testing.T) *Spool {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSpool(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func spoolFiles(t *testing.T, s *Spool, state string) int {
+	files, err := ioutil.ReadDir(filepath.Join(s.Dir, state))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestSpool(t *testing.T) {
+	s := tempSpool(t)
+	defer os.RemoveAll(s.Dir)
+
+	for _, data := range []string{"first", "second"} {
+		if _, err := s.Add("", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // names are timestamps
+	}
+
+	// Faxes come out in order of arrival
+	e, err := s.Next()
+	if err != nil || e == nil || string(e.Data) != "first" {
+		t.Fatalf("invalid first fax: %v %v", e, err)
+	}
+	if n := spoolFiles(t, s, SpoolPrinting); n != 1 {
+		t.Errorf("invalid number of faxes being printed: %d", n)
+	}
+
+	// A failed attempt is retried after the backoff
+	if retry, err := e.Retry(ErrPaperOut); !retry || err != nil {
+		t.Fatalf("fax not retried: %v", err)
+	}
+	if d := time.Until(e.RetryAt); d < 29*time.Second || d > s.MinBackoff {
+		t.Errorf("invalid backoff: %v", d)
+	}
+	if n, next, err := s.Pending(); n != 2 || !next.Before(time.Now()) || err != nil {
+		t.Errorf("invalid pending: %d %v %v", n, next, err)
+	}
+
+	e, err = s.Next()
+	if err != nil || e == nil || string(e.Data) != "second" {
+		t.Fatalf("invalid second fax: %v %v", e, err)
+	}
+	if err := e.Done(); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := s.Next(); e != nil || err != nil {
+		t.Errorf("fax printed before its retry time: %v %v", e, err)
+	}
+
+	// The attempts survive in the pending fax
+	pending, _ := s.list(SpoolPending)
+	if len(pending) != 1 || pending[0].Attempts != 1 || !pending[0].RetryAt.After(time.Now()) {
+		t.Errorf("invalid pending fax after retry: %+v", pending)
+	}
+	if n := spoolFiles(t, s, SpoolDone); n != 1 {
+		t.Errorf("invalid number of printed faxes: %d", n)
+	}
+}
+
+func TestSpoolDeadLetter(t *testing.T) {
+	s := tempSpool(t)
+	defer os.RemoveAll(s.Dir)
+	s.MaxAttempts = 3
+	s.MinBackoff = 0
+
+	s.Add("0123abcd", []byte("fax"))
+	for i := 1; i <= 3; i++ {
+		e, err := s.Next()
+		if err != nil || e == nil {
+			t.Fatalf("attempt %d: no fax: %v", i, err)
+		}
+		retry, err := e.Retry(errors.New("broken"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retry != (i < 3) {
+			t.Errorf("attempt %d: invalid retry: %v", i, retry)
+		}
+	}
+
+	if n := spoolFiles(t, s, SpoolPending); n != 0 {
+		t.Errorf("dead letter still pending")
+	}
+	// The fax and its error
+	if n := spoolFiles(t, s, SpoolFailed); n != 2 {
+		t.Errorf("invalid number of files in dead letters: %d", n)
+	}
+}
+
+func TestSpoolPrinterError(t *testing.T) {
+	s := tempSpool(t)
+	defer os.RemoveAll(s.Dir)
+	s.MaxAttempts = 3
+	s.MinBackoff = 0
+
+	// Printer problems don't count as attempts, however many they are
+	s.Add("0123abcd", []byte("fax"))
+	for i := 1; i <= 10; i++ {
+		e, err := s.Next()
+		if err != nil || e == nil {
+			t.Fatalf("attempt %d: no fax: %v", i, err)
+		}
+		retry, err := e.Retry(&PrinterError{ErrPaperOut})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !retry || e.Attempts != 0 {
+			t.Errorf("attempt %d: invalid retry: %v, %d attempts", i, retry, e.Attempts)
+		}
+	}
+
+	// Errors of the fax still do
+	e, _ := s.Next()
+	if retry, _ := e.Retry(errors.New("broken")); !retry || e.Attempts != 1 {
+		t.Errorf("invalid retry after error: %v, %d attempts", retry, e.Attempts)
+	}
+	if n := spoolFiles(t, s, SpoolFailed); n != 0 {
+		t.Errorf("invalid number of files in dead letters: %d", n)
+	}
+}
+
+func TestSpoolRecover(t *testing.T) {
+	s := tempSpool(t)
+	defer os.RemoveAll(s.Dir)
+
+	// A fax interrupted while printing, a half-written one, and one left
+	// in the spool by an older client
+	s.Add("", []byte("interrupted"))
+	if _, err := s.Next(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(s.Dir, spoolTmp, "0000000000000002.0.0"), []byte("half"), 0666)
+	ioutil.WriteFile(filepath.Join(s.Dir, "0000000000000001"), []byte("legacy"), 0666)
+
+	n, err := s.Recover()
+	if n != 2 || err != nil {
+		t.Fatalf("invalid recover: %d %v", n, err)
+	}
+	if n := spoolFiles(t, s, spoolTmp); n != 0 {
+		t.Errorf("half-written fax not removed")
+	}
+	for _, exp := range []string{"legacy", "interrupted"} {
+		e, err := s.Next()
+		if err != nil || e == nil || string(e.Data) != exp {
+			t.Errorf("invalid fax after recover: exp %q, got %v %v", exp, e, err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package common
+
+import (
+	"image"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+)
+
+// VirtualPrinter is an in-memory printer, which interprets the ESC/POS
+// stream and renders the printed paper as an image. It is meant for testing
+// and previews: glyphs are drawn with a basic bitmap font scaled to the size
+// of the printer fonts, so the output is close to the real one but not
+// pixel-exact.
+type VirtualPrinter struct {
+	m       sync.Mutex
+	pending []byte   // incomplete command from the previous write
+	rows    [][]byte // printed dots, packed like bit image graphics
+	mode    byte
+	x, y    int // in dots
+	lineh   int // height of the current line so far
+	status  PrinterStatus
+}
+
+func NewVirtualPrinter() *VirtualPrinter {
+	return &VirtualPrinter{}
+}
+
+func (p *VirtualPrinter) Connected() bool {
+	return true
+}
+
+// SetStatus changes the status reported by the printer.
+func (p *VirtualPrinter) SetStatus(st PrinterStatus) {
+	p.m.Lock()
+	p.status = st
+	p.m.Unlock()
+}
+
+func (p *VirtualPrinter) Status() (PrinterStatus, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.status, nil
+}
+
+func (p *VirtualPrinter) Write(buf []byte) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	data := append(p.pending, buf...)
+	for len(data) > 0 {
+		n := p.exec(data)
+		if n == 0 {
+			break // need more data
+		}
+		data = data[n:]
+	}
+	p.pending = append([]byte(nil), data...)
+	return len(buf), nil
+}
+
+// exec interprets the command at the beginning of data, and returns the
+// number of bytes consumed (0 if the command is incomplete).
+func (p *VirtualPrinter) exec(data []byte) int {
+	switch c := data[0]; {
+	case c == 0x1b:
+		if len(data) < 2 {
+			return 0
+		}
+		switch data[1] {
+		case '@': // initialize
+			p.mode = 0
+			return 2
+		case '!': // print mode
+			if len(data) < 3 {
+				return 0
+			}
+			p.mode = data[2]
+			return 3
+		case 'X': // Pipsta LED control
+			if len(data) < 4 {
+				return 0
+			}
+			return 4
+		case '*': // bit image graphics, a single row of dots
+			if len(data) < 5 {
+				return 0
+			}
+			n := int(data[3]) | int(data[4])<<8
+			if len(data) < 5+n {
+				return 0
+			}
+			p.graphics(data[5 : 5+n])
+			return 5 + n
+		}
+		return 2 // unknown command, hope it has no parameters
+	case c == '\n':
+		p.newline()
+	case c >= 0x20:
+		p.char(c)
+	}
+	return 1
+}
+
+func (p *VirtualPrinter) newline() {
+	if p.lineh == 0 {
+		p.lineh = charHeight(p.mode)
+	}
+	p.y += p.lineh
+	p.x, p.lineh = 0, 0
+}
+
+// dot sets a black dot on the paper.
+func (p *VirtualPrinter) dot(x, y int) {
+	if x < 0 || x >= PrinterDots {
+		return
+	}
+	for len(p.rows) <= y {
+		p.rows = append(p.rows, make([]byte, PrinterDots/8))
+	}
+	p.rows[y][x/8] |= 0x80 >> uint(x%8)
+}
+
+func (p *VirtualPrinter) graphics(dots []byte) {
+	for i, b := range dots {
+		for j := 0; j < 8; j++ {
+			if b&(0x80>>uint(j)) != 0 {
+				p.dot(i*8+j, p.y)
+			}
+		}
+	}
+	if p.lineh < 1 {
+		p.lineh = 1
+	}
+}
+
+var (
+	glyphsLock sync.Mutex
+	glyphs     = make(map[rune]*image.Alpha)
+)
+
+// glyphSubstitutes are used for the characters used by the layout that are
+// missing in the basic font, which only covers ASCII.
+var glyphSubstitutes = map[rune]rune{
+	'∙': '·',
+	'│': '|',
+	'■': '#',
+}
+
+// glyph returns the bitmap of a character in the basic font.
+func glyph(r rune) *image.Alpha {
+	glyphsLock.Lock()
+	defer glyphsLock.Unlock()
+	if g, found := glyphs[r]; found {
+		return g
+	}
+
+	face := basicfont.Face7x13
+	g := image.NewAlpha(image.Rect(0, 0, face.Advance, face.Height))
+	d := font.Drawer{Dst: g, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Ascent)}
+	draw := r
+	if sub, found := glyphSubstitutes[r]; found {
+		draw = sub
+	} else if r > unicode.MaxASCII {
+		// Drop accents, which is better than nothing
+		draw, _ = utf8.DecodeRuneInString(norm.NFD.String(string(r)))
+	}
+	d.DrawString(string(draw))
+	glyphs[r] = g
+	return g
+}
+
+func (p *VirtualPrinter) char(c byte) {
+	w, h := charWidth(p.mode), charHeight(p.mode)
+	if p.x+w > PrinterDots {
+		p.newline() // the printer wraps automatically
+	}
+
+	// Scale the glyph to the size of the character
+	g := glyph(charmap.CodePage437.DecodeByte(c))
+	gw, gh := g.Bounds().Dx(), g.Bounds().Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if g.AlphaAt(x*gw/w, y*gh/h).A < 0x80 {
+				continue
+			}
+			p.dot(p.x+x, p.y+y)
+			if p.mode&ModeEmphasized != 0 {
+				p.dot(p.x+x+1, p.y+y)
+			}
+		}
+	}
+	if p.mode&ModeUnderline != 0 {
+		for x := 0; x < w; x++ {
+			p.dot(p.x+x, p.y+h-1)
+		}
+	}
+
+	p.x += w
+	if p.lineh < h {
+		p.lineh = h
+	}
+}
+
+// Image returns the paper printed so far.
+func (p *VirtualPrinter) Image() *image.Paletted {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	height := p.y + p.lineh
+	if len(p.rows) > height {
+		height = len(p.rows)
+	}
+	img := image.NewPaletted(image.Rect(0, 0, PrinterDots, height), MonoPalette)
+	for y, row := range p.rows {
+		for x := 0; x < PrinterDots; x++ {
+			if row[x/8]&(0x80>>uint(x%8)) != 0 {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
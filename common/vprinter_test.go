@@ -0,0 +1,91 @@
+package common
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestVirtualPrinter(t *testing.T) {
+	var tests = []struct {
+		name   string
+		writes []string
+		height int
+	}{
+		{"empty", nil, 0},
+		{"newline", []string{"\n"}, 24},
+		{"text", []string{"ab\n"}, 24},
+		{"font B", []string{"\x1b!\x01ab\n"}, 17},
+		{"double height", []string{"\x1b!\x10a\x1b!\x00b\nc\n"}, 48 + 24},
+		{"auto wrap", []string{"\x1b!\x20abcdefghijklmnopq\n"}, 48},
+		{"unterminated line", []string{"ab"}, 24},
+		{"LED commands", []string{"\x1bX\x2d\x01", "\x1bX\x2d\x00"}, 0},
+		{"split command", []string{"\x1b", "!", "\x10", "a\n"}, 48},
+	}
+
+	for _, tc := range tests {
+		vp := NewVirtualPrinter()
+		for _, w := range tc.writes {
+			vp.Write([]byte(w))
+		}
+		if h := vp.Image().Bounds().Dy(); h != tc.height {
+			t.Errorf("%s: invalid paper height: got %d, exp %d", tc.name, h, tc.height)
+		}
+	}
+}
+
+func TestVirtualPrinterImage(t *testing.T) {
+	// Images printed through the virtual printer must come out unchanged
+	img := image.NewPaletted(image.Rect(0, 0, PrinterDots, 16), MonoPalette)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < PrinterDots; x++ {
+			if (x/3+y)%2 == 0 {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+
+	vp := NewVirtualPrinter()
+	vp.Write(EncodeImage(img))
+	got := vp.Image()
+	if got.Bounds() != img.Bounds() {
+		t.Fatalf("invalid image size: got %v, exp %v", got.Bounds(), img.Bounds())
+	}
+	for i := range img.Pix {
+		if got.Pix[i] != img.Pix[i] {
+			t.Fatalf("invalid dot at %d,%d", i%PrinterDots, i/PrinterDots)
+		}
+	}
+}
+
+func TestPreviewFax(t *testing.T) {
+	defer func(p Printer) { DefaultPrinter = p }(DefaultPrinter)
+	vp := NewVirtualPrinter()
+	DefaultPrinter = vp
+
+	pic := image.NewPaletted(image.Rect(0, 0, PrinterDots, 40), MonoPalette)
+	var buf bytes.Buffer
+	png.Encode(&buf, pic)
+	fax := &Fax{
+		Sender:    "Diego",
+		Timestamp: time.Date(2018, 10, 1, 10, 30, 0, 0, time.UTC),
+		Message:   "Ciao!",
+	}
+
+	// The preview is the paper printed by PrintFax, so it grows with the
+	// picture; the default printer must not be used
+	text := PreviewFax(fax)
+	fax.Picture = buf.Bytes()
+	full := PreviewFax(fax)
+	if text.Bounds().Dx() != PrinterDots || text.Bounds().Dy() == 0 {
+		t.Fatalf("invalid preview size: %v", text.Bounds())
+	}
+	if full.Bounds().Dy() <= text.Bounds().Dy() {
+		t.Errorf("invalid preview height with picture: got %d, text %d", full.Bounds().Dy(), text.Bounds().Dy())
+	}
+	if h := vp.Image().Bounds().Dy(); h != 0 {
+		t.Errorf("preview was printed on the default printer")
+	}
+}
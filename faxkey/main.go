@@ -0,0 +1,80 @@
+// faxkey manages the key pairs used to encrypt faxes between the backend
+// and the CryptoFaxPA devices.
+//
+// Usage:
+//
+//	faxkey gen <keyfile>      generate a new key pair, print the public key
+//	faxkey pub <keyfile>      print the public key of an existing key pair
+//	faxkey rotate <keyfile>   move the current key to <keyfile>.old and
+//	                          generate a new one, printing its public key
+//
+// After a rotation, the device keeps accepting faxes sealed for the old key
+// until the backend is reconfigured with the new public key; the .old file
+// can then be deleted. A rotation is refused while the .old file of the
+// previous one still exists, as overwriting it would lose the key the
+// backend might still be using.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rasky/CryptoFaxPA/common"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: faxkey gen|pub|rotate <keyfile>\n")
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+
+	cmd, fn := flag.Arg(0), flag.Arg(1)
+	var err error
+	switch cmd {
+	case "gen":
+		if _, serr := os.Stat(fn); serr == nil {
+			err = fmt.Errorf("%s already exists; use rotate to replace it", fn)
+			break
+		}
+		err = generate(fn)
+	case "pub":
+		var kp *common.KeyPair
+		if kp, err = common.LoadKeyPair(fn); err == nil {
+			fmt.Println(kp.Public.String())
+		}
+	case "rotate":
+		if _, serr := os.Stat(fn + ".old"); serr == nil {
+			err = fmt.Errorf("%s.old already exists; delete it once the backend uses the current key", fn)
+			break
+		}
+		if err = os.Rename(fn, fn+".old"); err == nil {
+			err = generate(fn)
+		}
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "faxkey: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate(fn string) error {
+	kp, err := common.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	if err := kp.Save(fn); err != nil {
+		return err
+	}
+	fmt.Println(kp.Public.String())
+	return nil
+}
@@ -6,12 +6,11 @@ require (
 	github.com/antonholmquist/jason v1.0.0
 	github.com/dustin/go-humanize v0.0.0-20180713052910-9f541cc9db5d
 	github.com/eclipse/paho.mqtt.golang v1.1.1
-	github.com/esimov/dithergo v0.0.0-20170530095937-48e039c66812
 	github.com/go-redis/cache v6.3.5+incompatible
 	github.com/go-redis/redis v6.14.1+incompatible
 	github.com/gobuffalo/packr v1.13.7
 	github.com/godbus/dbus v4.1.0+incompatible
-	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
+	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/gorilla/websocket v1.4.0 // indirect
 	github.com/guptarohit/asciigraph v0.4.1
 	github.com/kelseyhightower/envconfig v1.3.0
@@ -26,8 +25,8 @@ require (
 	github.com/rakyll/statik v0.1.5 // indirect
 	github.com/stianeikeland/go-rpio v3.0.1-0.20180606224349-3abdd2207d33+incompatible
 	github.com/vmihailenco/msgpack v4.0.0+incompatible
-	github.com/wcharczuk/go-chart v2.0.1+incompatible
-	golang.org/x/image v0.0.0-20180926015637-991ec62608f3 // indirect
+	golang.org/x/crypto v0.11.0
+	golang.org/x/image v0.0.0-20180926015637-991ec62608f3
 	golang.org/x/net v0.0.0-20180926154720-4dfa2610cdf3 // indirect
 	golang.org/x/text v0.3.0
 	google.golang.org/appengine v1.2.0 // indirect
@@ -2,11 +2,11 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os/exec"
@@ -18,7 +18,10 @@ import (
 	"github.com/rasky/CryptoFaxPA/common"
 )
 
-var flagListenAddr = flag.String("listen", "127.0.0.1:8080", "address to listen to")
+var (
+	flagListenAddr  = flag.String("listen", "127.0.0.1:8080", "address to listen to")
+	flagMarketCache = flag.String("market-cache", "/var/lib/cryptofax/market.json", "blockchain data cache, shared with the client")
+)
 
 var templ *template.Template
 
@@ -126,16 +129,30 @@ func pageHome(rw http.ResponseWriter, req *http.Request) {
 }
 
 func pageBlockchain(rw http.ResponseWriter, req *http.Request) {
-	infos, _ := common.GetBlockchainNerdInfos()
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+	defer cancel()
+
+	// Fetch both at once, so that the page waits at most the timeout
+	var graphs []common.PriceGraph
+	done := make(chan bool)
+	go func() {
+		graphs = common.GetAsciiPriceGraphs(ctx, 100, 30)
+		close(done)
+	}()
+	infos, err := common.GetBlockchainNerdInfos(ctx)
+	if err != nil {
+		log.Printf("[ERROR] cannot get blockchain infos: %v", err)
+	}
+	<-done
 
 	data := struct {
 		Active    string
 		NerdInfos []common.BlockchainNerdInfo
-		Graph     string
+		Graphs    []common.PriceGraph
 	}{
 		"blockchain",
 		infos,
-		common.GetBitcoinAsciiGraph(100, 30),
+		graphs,
 	}
 
 	if err := templ.ExecuteTemplate(rw, "blockchain.html", data); err != nil {
@@ -233,16 +250,12 @@ func pageConnectionRemove(rw http.ResponseWriter, req *http.Request) {
 }
 
 func pageVersion(rw http.ResponseWriter, req *http.Request) {
-	var version []byte
-
-	version, _ = ioutil.ReadFile("/var/cache/firmware.last_updated")
-
 	data := struct {
 		Active  string
 		Version string
 	}{
 		"version",
-		string(version),
+		common.FirmwareVersion(),
 	}
 
 	if err := templ.ExecuteTemplate(rw, "version.html", data); err != nil {
@@ -294,6 +307,7 @@ func pageVersionUpdate(rw http.ResponseWriter, req *http.Request) {
 
 func main() {
 	flag.Parse()
+	common.MarketCacheFile = *flagMarketCache
 	go gScanner.Run()
 
 	static := packr.NewBox("./assets/html")